@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nymo-net/nymo"
+)
+
+const (
+	// maxPacketSize is the largest packet of the core (64 KiB less its length prefix), and packetOverhead bounds what
+	// the core adds around a payload: encryption, keys, signature, proof-of-work and protobuf framing
+	maxPacketSize  = 1<<16 - 1 - 2
+	packetOverhead = 1 << 10
+	maxPayloadSize = maxPacketSize - packetOverhead
+
+	// the file data of a chunk is what fits in a payload besides its envelope once base64 encoded, see chunkDataSize
+	chunkSize         = maxPayloadSize / 4 * 3
+	minChunkSize      = 32 << 10
+	maxAttachmentSize = 16 << 20
+	maxChunks         = maxAttachmentSize / minChunkSize
+	maxFileName       = 255
+	maxMimeType       = 127
+
+	// files still missing chunks are limited per sender, and dropped if not completed in time
+	maxIncompleteFiles = 4
+	incompleteExpiry   = 24 * time.Hour
+)
+
+// fileChunk is a part of a file. Only the first chunk carries the name.
+type fileChunk struct {
+	Id    []byte `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Mime  string `json:"mime"`
+	Size  int64  `json:"size"`
+	Index uint   `json:"index"`
+	Total uint   `json:"total"`
+	Data  []byte `json:"data"`
+}
+
+func (c *fileChunk) validate() error {
+	switch {
+	case c == nil:
+		return errors.New("no file chunk")
+	case len(c.Id) != msgIdSize:
+		return errors.New("invalid file id")
+	case c.Total <= 0 || c.Total > maxChunks || c.Index >= c.Total:
+		return errors.New("invalid chunk index")
+	case c.Size < 0 || c.Size > maxAttachmentSize || len(c.Data) > chunkSize:
+		return errors.New("file too large")
+	case len(c.Name) > maxFileName || len(c.Mime) > maxMimeType:
+		return errors.New("file name too long")
+	}
+	return nil
+}
+
+type attachmentInfo struct {
+	Id   int64
+	Name string
+	Mime string
+	Size int64
+}
+
+// only raster images are previewed inline, as they cannot carry scripts
+var previewMimes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+func previewable(mime string) bool {
+	return previewMimes[mime]
+}
+
+func fileSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMG"[exp])
+}
+
+// fileName shortens a file name to maxFileName bytes, keeping its extension if short.
+func fileName(name string) string {
+	if len(name) <= maxFileName {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > maxFileName/4 {
+		ext = ""
+	}
+	// cut before a rune
+	n := maxFileName - len(ext)
+	for n > 0 && !utf8.RuneStart(name[n]) {
+		n--
+	}
+	return name[:n] + ext
+}
+
+// chunkDataSize returns the file data that fits in a payload along with the envelope of the first chunk, the largest.
+func chunkDataSize(env *envelope) (int, error) {
+	c := *env.File
+	c.Index, c.Total, c.Size = maxChunks-1, maxChunks, maxAttachmentSize
+	e := *env
+	e.File = &c
+	p, err := e.marshal()
+	if err != nil {
+		return 0, err
+	}
+	size := (maxPayloadSize - len(p)) / 4 * 3
+	if size < minChunkSize {
+		return 0, errors.New("file envelope too large")
+	}
+	return size, nil
+}
+
+func splitFile(id []byte, name, mime string, data []byte, group *groupInfo, expire uint) ([][]byte, error) {
+	env := &envelope{
+		Version:     envelopeVersion,
+		Id:          id,
+		Type:        envelopeFile,
+		ContentType: mime,
+		File: &fileChunk{
+			Id:   id,
+			Name: fileName(name),
+			Mime: mime,
+			Size: int64(len(data)),
+		},
+		Group:  group,
+		Expire: expire,
+	}
+	size, err := chunkDataSize(env)
+	if err != nil {
+		return nil, err
+	}
+
+	total := (len(data) + size - 1) / size
+	if total <= 0 {
+		total = 1
+	}
+	if total > maxChunks {
+		return nil, errors.New("file too large")
+	}
+
+	payloads := make([][]byte, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		c := *env.File
+		c.Index, c.Total, c.Data = uint(i), uint(total), data[i*size:end]
+		if i > 0 {
+			c.Name = ""
+		}
+		e := *env
+		e.File = &c
+		p, err := e.marshal()
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, p)
+	}
+	return payloads, nil
+}
+
+// storeChunk stores a received file chunk, and turns the file into a message once all chunks arrived. The file is
+// quarantined if any of its chunks is, as filters only see the name in the first one.
+func (db *database) storeChunk(conv conversation, env *envelope, sendTime time.Time, quarantine bool) (bool, bool, error) {
+	target := conv.Target
+	c := env.File
+	var incomplete int
+	err := db.QueryRow("SELECT COUNT(*) FROM `attachment` WHERE `target`=? AND `msg` IS NULL AND `file_id`<>?", target, c.Id).
+		Scan(&incomplete)
+	if err != nil {
+		return false, false, err
+	}
+	if incomplete >= maxIncompleteFiles {
+		log.WithField("target", target).Info("[webui] too many incomplete files, chunk dropped")
+		return false, false, nil
+	}
+
+	var name string
+	if c.Name != "" {
+		name = filepath.Base(c.Name)
+	}
+	_, err = db.Exec("INSERT INTO `attachment` (`target`,`file_id`,`name`,`mime`,`size`,`total`,`created`,`quarantine`) VALUES (?,?,?,?,?,?,?,?) "+
+		"ON CONFLICT (`target`, `file_id`) DO UPDATE SET `name`=CASE WHEN `excluded`.`name`<>'' THEN `excluded`.`name` ELSE `name` END, "+
+		"`quarantine`=`quarantine` OR `excluded`.`quarantine` WHERE `msg` IS NULL",
+		target, c.Id, name, c.Mime, c.Size, c.Total, time.Now().UnixMilli(), quarantine)
+	if err != nil {
+		return false, false, err
+	}
+
+	row := db.QueryRow("SELECT `rowid`, `name`, `mime`, `total`, `quarantine`, `msg` IS NOT NULL FROM `attachment` WHERE `target`=? AND `file_id`=?",
+		target, c.Id)
+	if row.Err() != nil {
+		return false, false, row.Err()
+	}
+	var info attachmentInfo
+	var total uint
+	var done bool
+	if err = row.Scan(&info.Id, &info.Name, &info.Mime, &total, &quarantine, &done); err != nil {
+		return false, false, err
+	}
+	if done || c.Index >= total {
+		return false, false, nil
+	}
+
+	_, err = db.Exec("INSERT OR IGNORE INTO `attachment_chunk` VALUES (?,?,?)", info.Id, c.Index, c.Data)
+	if err != nil {
+		return false, false, err
+	}
+
+	row = db.QueryRow("SELECT COUNT(*) FROM `attachment_chunk` WHERE `attachment`=?", info.Id)
+	if row.Err() != nil {
+		return false, false, row.Err()
+	}
+	var count uint
+	if err = row.Scan(&count); err != nil {
+		return false, false, err
+	}
+	if count < total {
+		return false, false, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, false, err
+	}
+	defer tx.Rollback()
+
+	query, err := tx.Query("SELECT `data` FROM `attachment_chunk` WHERE `attachment`=? ORDER BY `idx`", info.Id)
+	if err != nil {
+		return false, false, err
+	}
+	var data bytes.Buffer
+	for query.Next() {
+		var chunk []byte
+		if err = query.Scan(&chunk); err != nil {
+			_ = query.Close()
+			return false, false, err
+		}
+		data.Write(chunk)
+	}
+	if err = query.Err(); err != nil {
+		return false, false, err
+	}
+	info.Size = int64(data.Len())
+
+	exec, err := tx.Exec("INSERT OR IGNORE INTO `dec_msg` (`target`,`group`,`self`,`content`,`send_time`,`quarantine`,`msg_id`,`content_type`,`version`,`expire`,`expire_at`,`recv_time`) "+
+		"VALUES (?,?,FALSE,?,?,?,?,?,?,?,?,?)",
+		target, nullId(conv.Group), info.Name, sendTime.UnixMilli(), quarantine, c.Id, info.Mime, env.Version,
+		env.Expire, expireAt(sendTime, env.Expire), time.Now().UnixMilli())
+	if err != nil {
+		return false, false, err
+	}
+	if affected, err := exec.RowsAffected(); err != nil || affected <= 0 {
+		// duplicated message ID
+		return false, false, err
+	}
+	msgId, err := exec.LastInsertId()
+	if err != nil {
+		return false, false, err
+	}
+
+	_, err = tx.Exec("UPDATE `attachment` SET `data`=?, `size`=?, `msg`=? WHERE `rowid`=?", data.Bytes(), info.Size, msgId, info.Id)
+	if err != nil {
+		return false, false, err
+	}
+	_, err = tx.Exec("DELETE FROM `attachment_chunk` WHERE `attachment`=?", info.Id)
+	if err != nil {
+		return false, false, err
+	}
+	if err = tx.Commit(); err != nil {
+		return false, false, err
+	}
+
+	sender, err := db.groupSender(conv)
+	if err != nil {
+		return false, false, err
+	}
+
+	// only the first chunk carries the name, the webhook of the last one needs it too
+	c.Name = info.Name
+	go web.recvMessage(conv, msgRender{
+		Id:         msgId,
+		Content:    info.Name,
+		SendTime:   &sendTime,
+		Quarantine: quarantine,
+		Attachment: &info,
+		Sender:     sender,
+	})
+	return true, quarantine, nil
+}
+
+// sweepIncomplete deletes the received files not completed in time, along with their chunks.
+func (db *database) sweepIncomplete() error {
+	_, err := db.Exec("DELETE FROM `attachment` WHERE `msg` IS NULL AND `created`<?", time.Now().Add(-incompleteExpiry).UnixMilli())
+	return err
+}
+
+func (w *webui) serveUpload(wr http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(wr, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(wr, r.Body, maxAttachmentSize+(1<<20))
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxAttachmentSize+1))
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxAttachmentSize {
+		http.Error(wr, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var conv conversation
+	var addresses []*nymo.Address
+	var group *groupInfo
+	if g := r.FormValue("group"); g != "" {
+		id, err := strconv.ParseUint(g, 10, 0)
+		if err != nil {
+			http.Error(wr, "invalid group id", http.StatusBadRequest)
+			return
+		}
+		conv.Group = uint(id)
+		group, addresses, err = w.lookupGroup(conv.Group)
+		if err != nil {
+			http.Error(wr, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		id, err := strconv.ParseUint(r.FormValue("target"), 10, 0)
+		if err != nil {
+			http.Error(wr, "invalid receiver id", http.StatusBadRequest)
+			return
+		}
+		var address *nymo.Address
+		conv.Target, address, err = w.lookupTargetId(uint(id))
+		if err != nil {
+			http.Error(wr, err.Error(), http.StatusBadRequest)
+			return
+		}
+		addresses = []*nymo.Address{address}
+	}
+
+	over, err := w.db.overQuota()
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if over {
+		http.Error(wr, "storage quota exceeded", http.StatusInsufficientStorage)
+		return
+	}
+
+	info := attachmentInfo{
+		Name: fileName(filepath.Base(header.Filename)),
+		Mime: header.Header.Get("Content-Type"),
+		Size: int64(len(data)),
+	}
+	if info.Mime == "" || len(info.Mime) > maxMimeType {
+		info.Mime = http.DetectContentType(data)
+	}
+
+	fileId, err := newMessageId()
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	expire, err := w.db.getExpiry(conv)
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	payloads, err := splitFile(fileId, info.Name, info.Mime, data, group, expire)
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	insertId, err := w.db.insertAttachment(conv, fileId, &info, data, len(payloads), expire)
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	go w.sendMessage(conv, addresses, msgRender{Id: insertId, Self: true, Content: info.Name, Attachment: &info}, payloads)
+	wr.WriteHeader(http.StatusNoContent)
+}
+
+func (db *database) insertAttachment(conv conversation, fileId []byte, info *attachmentInfo, data []byte, total int, expire uint) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	exec, err := tx.Exec("INSERT INTO `dec_msg` (`target`,`group`,`self`,`content`,`msg_id`,`content_type`,`version`,`expire`) VALUES (?,?,TRUE,?,?,?,?,?)",
+		conv.Target, nullId(conv.Group), info.Name, fileId, info.Mime, envelopeVersion, expire)
+	if err != nil {
+		return 0, err
+	}
+	msgId, err := exec.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	exec, err = tx.Exec("INSERT INTO `attachment` (`target`,`file_id`,`msg`,`name`,`mime`,`size`,`total`,`data`) VALUES (?,?,?,?,?,?,?,?)",
+		conv.Target, fileId, msgId, info.Name, info.Mime, info.Size, total, data)
+	if err != nil {
+		return 0, err
+	}
+	info.Id, err = exec.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return msgId, tx.Commit()
+}
+
+func (w *webui) serveAttachment(wr http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.NotFound(wr, r)
+		return
+	}
+
+	row := w.db.QueryRowContext(r.Context(), "SELECT `name`, `mime`, `data` FROM `attachment` WHERE `rowid`=? AND `data` IS NOT NULL", id)
+	var name, mimeType string
+	var data []byte
+	if err = row.Scan(&name, &mimeType, &data); err != nil {
+		if err == sql.ErrNoRows {
+			http.NotFound(wr, r)
+		} else {
+			http.Error(wr, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	disposition := "attachment"
+	if previewable(mimeType) {
+		disposition = "inline"
+	} else {
+		mimeType = "application/octet-stream"
+	}
+	h := wr.Header()
+	h.Set("Content-Type", mimeType)
+	h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	h.Set("Content-Security-Policy", "sandbox")
+	h.Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(wr, r, name, time.Time{}, bytes.NewReader(data))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/nymo-net/nymo"
+	"github.com/nymo-net/nymo/pb"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// packetStore keeps the messages the core stores instead of storing them.
+type packetStore struct {
+	*database
+	stored []*pb.MsgContainer
+}
+
+func (s *packetStore) StoreMessage(_ [32]byte, c *pb.MsgContainer, _ func() (uint32, error)) error {
+	s.stored = append(s.stored, c)
+	return nil
+}
+
+func TestFileName(t *testing.T) {
+	for _, test := range []struct{ name, want string }{
+		{"photo.jpg", "photo.jpg"},
+		{strings.Repeat("a", 300) + ".jpg", strings.Repeat("a", maxFileName-4) + ".jpg"},
+		{strings.Repeat("a", 300) + "." + strings.Repeat("b", 100), strings.Repeat("a", maxFileName)},
+		{strings.Repeat("é", 200), strings.Repeat("é", maxFileName/2)},
+	} {
+		got := fileName(test.name)
+		if got != test.want || len(got) > maxFileName || !utf8.ValidString(got) {
+			t.Errorf("fileName(%.20q...) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSplitFile(t *testing.T) {
+	id, err := newMessageId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 3*chunkSize)
+	if _, err = rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	payloads, err := splitFile(id, "file.bin", "application/octet-stream", data, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var joined []byte
+	for i, p := range payloads {
+		env, err := parsePayload(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = env.File.validate(); err != nil {
+			t.Fatalf("chunk %d: %s", i, err)
+		}
+		if env.File.Index != uint(i) || env.File.Total != uint(len(payloads)) {
+			t.Fatalf("chunk %d: index %d of %d", i, env.File.Index, env.File.Total)
+		}
+		if (env.File.Name != "") != (i == 0) {
+			t.Errorf("chunk %d: name %q", i, env.File.Name)
+		}
+		joined = append(joined, env.File.Data...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Error("chunks do not add up to the file")
+	}
+}
+
+func TestSplitFileFitsPacket(t *testing.T) {
+	key, err := nymo.GenerateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &packetStore{database: testDatabase(t)}
+	user := nymo.OpenUser(store, key, tls.Certificate{Certificate: [][]byte{nil}}, nil)
+
+	// the largest envelope: a long name, and a full group with a long name
+	group := &groupInfo{Name: strings.Repeat("g", 1000)}
+	if group.Id, err = newMessageId(); err != nil {
+		t.Fatal(err)
+	}
+	for len(group.Members) < maxGroupMembers {
+		group.Members = append(group.Members, testAddress(t).Bytes())
+	}
+	data := make([]byte, 2*chunkSize)
+	if _, err = rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	payloads, err := splitFile(group.Id, strings.Repeat("\"", 1000), strings.Repeat("m", maxMimeType), data, group, 1<<31)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first chunk is the largest
+	if err = user.NewMessage(user.Address(), payloads[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := anypb.New(store.stored[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packet) > maxPacketSize {
+		t.Fatalf("packet of %d bytes for a payload of %d, over %d", len(packet), len(payloads[0]), maxPacketSize)
+	}
+	if len(payloads[0]) > maxPayloadSize {
+		t.Fatalf("payload of %d bytes, over %d", len(payloads[0]), maxPayloadSize)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/nymo-net/nymo"
+)
+
+// replyRule answers matching direct text messages automatically. Rules from the config file have no ID and cannot
+// be changed through the web UI.
+type replyRule struct {
+	Id      uint   `json:"id,omitempty"`
+	Sender  string `json:"sender,omitempty"`
+	Content string `json:"content,omitempty"`
+	Reply   string `json:"reply"`
+	Enabled bool   `json:"enabled"`
+
+	sender  []byte
+	content *regexp.Regexp
+}
+
+var (
+	configRules []replyRule
+	// replyLimits holds a token bucket of automatic replies per contact.
+	replyLimits sync.Map
+)
+
+func (r *replyRule) compile() error {
+	r.Sender, r.Content, r.Reply = strings.TrimSpace(r.Sender), strings.TrimSpace(r.Content), strings.TrimSpace(r.Reply)
+	if r.Reply == "" {
+		return errors.New("empty reply")
+	}
+	r.sender, r.content = nil, nil
+	if r.Sender != "" {
+		addr := nymo.NewAddress(r.Sender)
+		if addr == nil {
+			return errors.New("invalid sender address")
+		}
+		r.sender = addr.Bytes()
+	}
+	if r.Content != "" {
+		var err error
+		if r.content, err = regexp.Compile(r.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// answer returns the reply of the rule to a message, expanding the submatches of the content expression.
+func (r *replyRule) answer(sender []byte, text string) (string, bool) {
+	if !r.Enabled || r.sender != nil && !bytes.Equal(r.sender, sender) {
+		return "", false
+	}
+	if r.content == nil {
+		return r.Reply, true
+	}
+	match := r.content.FindStringSubmatchIndex(text)
+	if match == nil {
+		return "", false
+	}
+	return string(r.content.ExpandString(nil, r.Reply, text, match)), true
+}
+
+func compileReplyRules() error {
+	for i, c := range config.AutoReply {
+		r := replyRule{Sender: c.Sender, Content: c.Content, Reply: c.Reply, Enabled: true}
+		if err := r.compile(); err != nil {
+			return fmt.Errorf("auto reply #%d: %w", i, err)
+		}
+		configRules = append(configRules, r)
+	}
+	return nil
+}
+
+// replyRules returns the rules from the config file followed by the ones stored in the database. They are compiled
+// once and cached until invalidateRules.
+func (db *database) replyRules() ([]replyRule, error) {
+	db.rulesLock.Lock()
+	defer db.rulesLock.Unlock()
+	if db.rules != nil {
+		return db.rules, nil
+	}
+
+	rules := append(make([]replyRule, 0, len(configRules)), configRules...)
+
+	query, err := db.Query("SELECT `rowid`, IFNULL(`sender`, ''), IFNULL(`content`, ''), `reply`, `enabled` FROM `auto_reply` ORDER BY `rowid`")
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+
+	for query.Next() {
+		var r replyRule
+		if err = query.Scan(&r.Id, &r.Sender, &r.Content, &r.Reply, &r.Enabled); err != nil {
+			return nil, err
+		}
+		if err = r.compile(); err != nil {
+			return nil, fmt.Errorf("auto reply %d: %w", r.Id, err)
+		}
+		rules = append(rules, r)
+	}
+	if err = query.Err(); err != nil {
+		return nil, err
+	}
+	db.rules = rules
+	return rules, nil
+}
+
+func (db *database) invalidateRules() {
+	db.rulesLock.Lock()
+	db.rules = nil
+	db.rulesLock.Unlock()
+}
+
+// allowReply takes a token from the automatic reply bucket of the contact.
+func (db *database) allowReply(target uint) bool {
+	b, _ := replyLimits.LoadOrStore(target, newTokenBucket(db.limit.AutoReplyRate, db.limit.AutoReplyInterval))
+	return b.(*tokenBucket).take(1) > 0
+}
+
+// autoReply answers a received message with the first matching rule, at most at the configured rate per contact.
+func (db *database) autoReply(target uint, sender []byte, env *envelope) error {
+	if env.Auto || env.Type != envelopeText {
+		return nil
+	}
+
+	rules, err := db.replyRules()
+	if err != nil {
+		return err
+	}
+	for i := range rules {
+		reply, ok := rules[i].answer(sender, env.Text)
+		if !ok {
+			continue
+		}
+
+		if !db.allowReply(target) {
+			log.WithField("target", target).Info("[webui] auto reply rate limited")
+			return nil
+		}
+
+		// sending stores the message, which must not happen while storing the received one
+		go func() {
+			if err := web.sendText(&newMessage{Target: float64(target), Message: reply}, true); err != nil {
+				log.WithField("target", target).Warnf("[webui] auto reply: %s", err)
+			}
+		}()
+		return nil
+	}
+	return nil
+}
+
+func (w *webui) broadcastRules() error {
+	rules, err := w.db.replyRules()
+	if err != nil {
+		return err
+	}
+	go w.broadcast("rules", rules)
+	return nil
+}
+
+func (w *webui) setRule(msg json.RawMessage) error {
+	var r replyRule
+	if err := json.Unmarshal(msg, &r); err != nil {
+		return err
+	}
+	if err := r.compile(); err != nil {
+		return err
+	}
+
+	sender, content := &r.Sender, &r.Content
+	if r.Sender == "" {
+		sender = nil
+	}
+	if r.Content == "" {
+		content = nil
+	}
+	var err error
+	if r.Id > 0 {
+		_, err = w.db.Exec("UPDATE `auto_reply` SET `sender`=?, `content`=?, `reply`=?, `enabled`=? WHERE `rowid`=?",
+			sender, content, r.Reply, r.Enabled, r.Id)
+	} else {
+		_, err = w.db.Exec("INSERT INTO `auto_reply` (`sender`, `content`, `reply`, `enabled`) VALUES (?,?,?,?)",
+			sender, content, r.Reply, r.Enabled)
+	}
+	if err != nil {
+		return err
+	}
+	w.db.invalidateRules()
+	return w.broadcastRules()
+}
+
+func (w *webui) deleteRule(msg json.RawMessage) error {
+	var id uint
+	if err := json.Unmarshal(msg, &id); err != nil {
+		return err
+	}
+
+	if _, err := w.db.Exec("DELETE FROM `auto_reply` WHERE `rowid`=?", id); err != nil {
+		return err
+	}
+	w.db.invalidateRules()
+	return w.broadcastRules()
+}
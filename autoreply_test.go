@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/nymo-net/nymo"
+)
+
+// testAddress returns the address of a new identity.
+func testAddress(t *testing.T) *nymo.Address {
+	t.Helper()
+	key, err := nymo.GenerateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return nymo.OpenUser(nil, key, tls.Certificate{Certificate: [][]byte{nil}}, nil).Address()
+}
+
+func TestReplyRuleCompile(t *testing.T) {
+	for _, r := range []replyRule{
+		{Reply: " "},
+		{Sender: "nymo://invalid", Reply: "hi"},
+		{Content: "(", Reply: "hi"},
+	} {
+		if err := r.compile(); err == nil {
+			t.Errorf("compiled invalid rule %+v", r)
+		}
+	}
+}
+
+func TestReplyRuleAnswer(t *testing.T) {
+	addr := testAddress(t)
+	other := []byte("someone else")
+
+	tests := []struct {
+		rule   replyRule
+		sender []byte
+		text   string
+		reply  string
+		ok     bool
+	}{
+		{replyRule{Reply: "away", Enabled: true}, other, "hello", "away", true},
+		{replyRule{Reply: "away"}, other, "hello", "", false},
+		{replyRule{Sender: addr.String(), Reply: "hi", Enabled: true}, addr.Bytes(), "hello", "hi", true},
+		{replyRule{Sender: addr.String(), Reply: "hi", Enabled: true}, other, "hello", "", false},
+		{replyRule{Content: `(?i)^ping$`, Reply: "pong", Enabled: true}, other, "PING", "pong", true},
+		{replyRule{Content: `^ping$`, Reply: "pong", Enabled: true}, other, "ping pong", "", false},
+		{replyRule{Content: `^order (\d+)$`, Reply: "order $1 received", Enabled: true}, other, "order 42", "order 42 received", true},
+		{replyRule{Content: `^(?P<name>\w+) here$`, Reply: "hi ${name}", Enabled: true}, other, "bob here", "hi bob", true},
+	}
+	for _, test := range tests {
+		if err := test.rule.compile(); err != nil {
+			t.Fatalf("%+v: %s", test.rule, err)
+		}
+		reply, ok := test.rule.answer(test.sender, test.text)
+		if reply != test.reply || ok != test.ok {
+			t.Errorf("%+v on %q: got %q, %v, want %q, %v", test.rule, test.text, reply, ok, test.reply, test.ok)
+		}
+	}
+}
+
+func TestReplyRulesCache(t *testing.T) {
+	db := testDatabase(t)
+	if _, err := db.Exec("INSERT INTO `auto_reply` (`content`, `reply`) VALUES ('^a$', 'first')"); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := db.replyRules()
+	if err != nil || len(rules) != 1 || rules[0].Reply != "first" || rules[0].content == nil {
+		t.Fatalf("rules %+v, err %v", rules, err)
+	}
+
+	if _, err = db.Exec("INSERT INTO `auto_reply` (`reply`) VALUES ('second')"); err != nil {
+		t.Fatal(err)
+	}
+	if rules, _ = db.replyRules(); len(rules) != 1 {
+		t.Fatalf("cached rules changed: %+v", rules)
+	}
+
+	db.invalidateRules()
+	if rules, err = db.replyRules(); err != nil || len(rules) != 2 || rules[1].Reply != "second" {
+		t.Fatalf("rules after invalidation %+v, err %v", rules, err)
+	}
+}
+
+func TestAllowReply(t *testing.T) {
+	db := testDatabase(t)
+	db.limit = &limitConfig{AutoReplyRate: 2, AutoReplyInterval: time.Hour}
+	t.Cleanup(func() {
+		replyLimits.Delete(uint(1))
+		replyLimits.Delete(uint(2))
+	})
+
+	for i := 0; i < 2; i++ {
+		if !db.allowReply(1) {
+			t.Fatalf("reply %d refused", i)
+		}
+	}
+	if db.allowReply(1) {
+		t.Error("reply over the rate allowed")
+	}
+	if !db.allowReply(2) {
+		t.Error("reply to another contact refused")
+	}
+}
@@ -57,10 +57,50 @@ type tomlConfig struct {
 		EnableLpa       bool      `toml:"enable_lp_announcement"`
 		EnableLpd       bool      `toml:"enable_lp_discovery"`
 	} `toml:"core"`
+
+	Limit struct {
+		DigestRate        *uint     `toml:"digest_rate"`
+		DigestInterval    *duration `toml:"digest_interval"`
+		MaxSessionDigests *uint     `toml:"max_session_digests"`
+		MaxSessionPeers   *uint     `toml:"max_session_peers"`
+		MaxPenalty        *uint     `toml:"max_penalty"`
+		PenaltyExpiry     *duration `toml:"penalty_expiry"`
+		MaxStorage        int64     `toml:"max_storage"`
+		AutoReplyRate     *uint     `toml:"auto_reply_rate"`
+		AutoReplyInterval *duration `toml:"auto_reply_interval"`
+	} `toml:"limit"`
+
+	Filter []struct {
+		Sender      string `toml:"sender"`
+		Content     string `toml:"content"`
+		LargerThan  int    `toml:"larger_than"`
+		SmallerThan int    `toml:"smaller_than"`
+		Action      string `toml:"action"`
+	} `toml:"filter"`
+
+	AutoReply []struct {
+		Sender  string `toml:"sender"`
+		Content string `toml:"content"`
+		Reply   string `toml:"reply"`
+	} `toml:"auto_reply"`
+
+	Webhook []struct {
+		Url         string   `toml:"url"`
+		Secret      string   `toml:"secret"`
+		Events      []string `toml:"events"`
+		Contacts    []string `toml:"contacts"`
+		MaxAttempts uint     `toml:"max_attempts"`
+	} `toml:"webhook"`
 }
 
-func createDB() error {
-	key, err := nymo.GenerateUser()
+func createDB(keyFile string) error {
+	var key []byte
+	var err error
+	if keyFile != "" {
+		key, err = importKey(keyFile)
+	} else {
+		key, err = nymo.GenerateUser()
+	}
 	if err != nil {
 		return err
 	}
@@ -142,8 +182,11 @@ func notExists(path string) bool {
 	return os.IsNotExist(err)
 }
 
-func init() {
+// loadConfig parses the flags and the config file, and creates the database and TLS key pair if missing.
+func loadConfig() {
 	s := flag.String("config", "config.toml", "config file path")
+	exportFile := flag.String("export-key", "", "write the identity key to `file` for linking another device, and exit")
+	importFile := flag.String("import-key", "", "create the database with the identity key from `file`, to link this device")
 	flag.Parse()
 
 	log.Formatter = &logrus.TextFormatter{
@@ -158,11 +201,31 @@ func init() {
 	}
 	log.SetLevel(config.LogLevel)
 
+	if err := compileFilters(); err != nil {
+		log.Fatal(err)
+	}
+	if err := compileReplyRules(); err != nil {
+		log.Fatal(err)
+	}
+	if err := compileWebhooks(); err != nil {
+		log.Fatal(err)
+	}
+
+	if *exportFile != "" {
+		if err := exportKey(*exportFile); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("[webui] identity key written to %s, keep it secret", *exportFile)
+		os.Exit(0)
+	}
+
 	if notExists(config.Database) {
 		log.Warn("[webui] database not found, creating a new one.")
-		if err := createDB(); err != nil {
+		if err := createDB(*importFile); err != nil {
 			log.Fatal(err)
 		}
+	} else if *importFile != "" {
+		log.Fatal("[webui] database exists already, cannot import the identity key")
 	}
 
 	if notExists(config.Peer.TLSCert) || notExists(config.Peer.TLSKey) {
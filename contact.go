@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxTags       = 16
+	maxTagLength  = 32
+	maxAvatarSize = 256 << 10
+)
+
+type setNote struct {
+	Id   uint    `json:"id"`
+	Note *string `json:"note,omitempty"`
+}
+
+type setTags struct {
+	Id   uint     `json:"id"`
+	Tags []string `json:"tags"`
+}
+
+type setAvatar struct {
+	Id     uint `json:"id"`
+	Avatar bool `json:"avatar"`
+}
+
+// normalizeTags trims and deduplicates tags. Commas are not allowed, as tags are rendered comma separated.
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool)
+	var ret []string
+	for _, t := range tags {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[t] {
+			continue
+		}
+		if len(t) > maxTagLength || strings.ContainsRune(t, ',') {
+			return nil, errors.New("invalid tag")
+		}
+		seen[t] = true
+		ret = append(ret, t)
+	}
+	if len(ret) > maxTags {
+		return nil, errors.New("too many tags")
+	}
+	return ret, nil
+}
+
+func (w *webui) setNote(msg json.RawMessage) error {
+	var nm setNote
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+	if nm.Note != nil && strings.TrimSpace(*nm.Note) == "" {
+		nm.Note = nil
+	}
+
+	_, err := w.db.Exec("UPDATE `user` SET `note`=? WHERE `rowid`=? AND `rowid`>0", nm.Note, nm.Id)
+	if err != nil {
+		return err
+	}
+
+	go w.broadcast("note", nm)
+	return nil
+}
+
+func (w *webui) setTags(msg json.RawMessage) error {
+	var nm setTags
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+	tags, err := normalizeTags(nm.Tags)
+	if err != nil {
+		return err
+	}
+	nm.Tags = tags
+
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM `user_tag` WHERE `user`=?", nm.Id)
+	if err != nil {
+		return err
+	}
+	for _, t := range nm.Tags {
+		_, err = tx.Exec("INSERT INTO `user_tag` VALUES (?,?)", nm.Id, t)
+		if err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	go w.broadcast("tags", nm)
+	return nil
+}
+
+// touchContact records that we heard from a contact.
+func (db *database) touchContact(id uint, t time.Time) error {
+	_, err := db.Exec("UPDATE `user` SET `last_seen`=MAX(IFNULL(`last_seen`, 0), ?) WHERE `rowid`=?", t.UnixMilli(), id)
+	return err
+}
+
+// serveAvatar serves (GET), sets (POST with a file) or removes (DELETE) the locally chosen avatar of a contact.
+func (w *webui) serveAvatar(wr http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 0)
+	if err != nil || id <= 0 {
+		http.Error(wr, "invalid contact id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		row := w.db.QueryRowContext(r.Context(), "SELECT `avatar_mime`, `avatar` FROM `user` WHERE `rowid`=? AND `avatar` IS NOT NULL", id)
+		var mimeType string
+		var data []byte
+		if err = row.Scan(&mimeType, &data); err != nil {
+			if err == sql.ErrNoRows {
+				http.NotFound(wr, r)
+			} else {
+				http.Error(wr, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		h := wr.Header()
+		h.Set("Content-Type", mimeType)
+		h.Set("Content-Security-Policy", "sandbox")
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Cache-Control", "no-cache")
+		_, _ = wr.Write(data)
+		return
+	case http.MethodPost:
+		r.Body = http.MaxBytesReader(wr, r.Body, maxAvatarSize+(1<<10)*64)
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(wr, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		data, err := io.ReadAll(io.LimitReader(file, maxAvatarSize+1))
+		if err != nil {
+			http.Error(wr, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(data) > maxAvatarSize {
+			http.Error(wr, "avatar too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		mimeType := http.DetectContentType(data)
+		if !previewable(mimeType) {
+			http.Error(wr, "unsupported image type", http.StatusUnsupportedMediaType)
+			return
+		}
+		_, err = w.db.Exec("UPDATE `user` SET `avatar`=?, `avatar_mime`=? WHERE `rowid`=?", data, mimeType, id)
+	case http.MethodDelete:
+		_, err = w.db.Exec("UPDATE `user` SET `avatar`=NULL, `avatar_mime`=NULL WHERE `rowid`=?", id)
+	default:
+		http.Error(wr, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	go w.broadcast("avatar", setAvatar{Id: uint(id), Avatar: r.Method == http.MethodPost})
+	wr.WriteHeader(http.StatusNoContent)
+}
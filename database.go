@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/nymo-net/nymo"
@@ -15,6 +19,25 @@ import (
 type database struct {
 	*sql.DB
 	storeLock sync.Mutex
+	limit     *limitConfig
+	// peerLimits holds the *peerLimit of the peers by row id
+	peerLimits sync.Map
+
+	// rules caches the compiled auto reply rules, see replyRules
+	rulesLock sync.Mutex
+	rules     []replyRule
+}
+
+// authoredStore is the database as seen by the core while sending one of our messages, see sendAuthored. The message it
+// stores is recorded as authored by the dec_msg row (if any), tracing its propagation if trace is set.
+type authoredStore struct {
+	*database
+	row   int64
+	trace bool
+}
+
+func (s *authoredStore) StoreMessage(hash [32]byte, c *pb.MsgContainer, f func() (cohort uint32, err error)) error {
+	return s.storeMessage(hash, c, f, s)
 }
 
 func (db *database) IgnoreMessage(digest *pb.Digest) {
@@ -32,8 +55,9 @@ func (db *database) ClientHandle(id [8]byte) nymo.PeerHandle {
 	}
 	encoded := hex.EncodeToString(id[:])
 	log.WithField("id", encoded).Debug("[core] client connected")
+	peerSeen(db.DB, rowId, nil)
 	web.peer.Store(rowId, encoded)
-	return &peerHandle{db: db.DB, row: rowId}
+	return newPeerHandle(db, rowId, encoded, nil)
 }
 
 func (db *database) AddPeer(url string, digest *pb.Digest) {
@@ -45,12 +69,14 @@ func (db *database) AddPeer(url string, digest *pb.Digest) {
 }
 
 func (db *database) EnumeratePeers() nymo.PeerEnumerate {
-	query, err := db.Query("SELECT `url_hash`, `url`, `cohort` FROM `peer_link` ORDER BY `penalize`")
+	// the penalties of the peers last dialed at a URL count as its own
+	query, err := db.Query("SELECT `l`.`url_hash`, `l`.`url`, `l`.`cohort` FROM `peer_link` `l` ORDER BY `l`.`penalize` + " +
+		"(SELECT IFNULL(MAX(`penalize`), 0) FROM `peer` WHERE `url_hash`=`l`.`url_hash`)")
 	if err != nil {
 		log.Panic(err)
 	}
 	return &peerEnum{
-		db:   db.DB,
+		db:   db,
 		rows: query,
 	}
 }
@@ -82,10 +108,15 @@ func (db *database) GetMessage(hash [32]byte) (msg []byte, pow uint64) {
 }
 
 func (db *database) StoreMessage(hash [32]byte, c *pb.MsgContainer, f func() (cohort uint32, err error)) error {
+	return db.storeMessage(hash, c, f, nil)
+}
+
+// storeMessage stores a message from a peer, or one we are sending if own is set.
+func (db *database) storeMessage(hash [32]byte, c *pb.MsgContainer, f func() (cohort uint32, err error), own *authoredStore) error {
 	db.storeLock.Lock()
 	defer db.storeLock.Unlock()
 
-	row := db.QueryRow("SELECT COUNT(*) FROM `message` WHERE `hash`=? AND `msg` IS NOT NULL", hash[:])
+	row := db.QueryRow("SELECT COUNT(`msg`) FROM `message` WHERE `hash`=?", hash[:])
 	if row.Err() != nil {
 		return row.Err()
 	}
@@ -104,22 +135,260 @@ func (db *database) StoreMessage(hash [32]byte, c *pb.MsgContainer, f func() (co
 		return err
 	}
 
+	over, err := db.overQuota()
+	if err != nil {
+		return err
+	}
+	if over {
+		if own != nil {
+			return errors.New("storage quota exceeded")
+		}
+		log.WithField("hash", hex.EncodeToString(hash[:])).Warn("[core] storage quota exceeded, message dropped")
+		_, err = db.Exec("INSERT OR IGNORE INTO `message` (`hash`,`cohort`,`deleted`) VALUES(?,?,TRUE)", hash[:], cohort)
+		return err
+	}
+
 	_, err = db.Exec("INSERT INTO `message` (`hash`,`cohort`,`msg`,`pow`) VALUES (?,?,@msg,@pow) ON CONFLICT DO UPDATE SET `msg`=@msg,`pow`=@pow",
 		hash[:], cohort, sql.Named("msg", c.Msg), sql.Named("pow", c.Pow))
-	return err
+	if err != nil {
+		return err
+	}
+
+	if own != nil && own.row > 0 {
+		_, err = db.Exec("INSERT OR IGNORE INTO `authored` SELECT ?, `rowid`, ? FROM `message` WHERE `hash`=? AND `cohort`=?",
+			own.row, own.trace, hash[:], cohort)
+		return err
+	}
+	return nil
 }
 
 func (db *database) StoreDecryptedMessage(message *nymo.Message) {
-	target, err := db.lookupUserId(message.Sender.Bytes())
+	env, err := parsePayload(message.Content)
+	if err != nil {
+		log.WithField("sender", message.Sender).Warnf("[webui] malformed payload: %s", err)
+		return
+	}
+
+	sender := message.Sender.Bytes()
+	if bytes.Equal(sender, web.user.Address().Bytes()) {
+		// only our other devices can send to ourselves
+		if err = db.storeSync(env, message.SendTime); err != nil {
+			log.Panic(err)
+		}
+		return
+	}
+	action := applyFilters(sender, env)
+	if action == filterDrop {
+		log.WithField("sender", message.Sender).Info("[webui] message dropped by filter")
+		return
+	}
+
+	target, err := db.lookupUserId(sender, contactRequest)
 	if err != nil {
 		log.Panic(err)
 	}
-	_, err = db.Exec("INSERT INTO `dec_msg` VALUES (?,FALSE,?,?)",
-		target, message.Content, message.SendTime.UnixMilli())
+	state, err := db.getUserState(target)
+	if err != nil {
+		log.Panic(err)
+	}
+	if state == contactBlocked {
+		log.WithField("sender", message.Sender).Debug("[webui] message from blocked contact dropped")
+		return
+	}
+
+	seen := message.SendTime
+	if now := time.Now(); seen.After(now) {
+		seen = now
+	}
+	if err = db.touchContact(target, seen); err != nil {
+		log.Panic(err)
+	}
+
+	conv := conversation{Target: target}
+	if env.Group != nil && env.Type != envelopeGroup {
+		conv.Group, err = db.resolveGroup(target, sender, env.Group)
+		if err != nil {
+			log.Panic(err)
+		}
+		if conv.Group <= 0 {
+			log.WithField("sender", message.Sender).Info("[webui] message to unjoined group dropped")
+			return
+		}
+	}
+
+	if env.Version > 0 && (env.Type == envelopeText || env.Type == envelopeFile || env.Type == envelopeContact) {
+		if env.Expire > maxExpiry {
+			env.Expire = maxExpiry
+		}
+		if err = db.syncExpiry(conv, env.Expire, message.SendTime); err != nil {
+			log.Panic(err)
+		}
+	}
+
+	quarantine := action == filterQuarantine
+	stored := false
+	switch env.Type {
+	case envelopeText:
+		stored, err = db.storeText(conv, env, message.SendTime, quarantine)
+	case envelopeFile:
+		if err := env.File.validate(); err != nil {
+			log.WithField("sender", message.Sender).Warnf("[webui] invalid file chunk: %s", err)
+			return
+		}
+		stored, quarantine, err = db.storeChunk(conv, env, message.SendTime, quarantine)
+	case envelopeReceipt:
+		if err := validateRefs(env.Refs); err != nil || env.Receipt <= receiptNone || env.Receipt > receiptRead {
+			log.WithField("sender", message.Sender).Warn("[webui] invalid receipt")
+			return
+		}
+		var ids []int64
+		ids, err = db.applyReceipt(target, env)
+		if len(ids) > 0 {
+			go web.broadcast("receipt", receiptUpdate{Target: target, Ids: ids, Status: env.Receipt})
+		}
+	case envelopeGroup:
+		if env.Group == nil {
+			log.WithField("sender", message.Sender).Warn("[webui] invalid group update")
+			return
+		}
+		err = db.storeGroupUpdate(target, sender, env.Group)
+	case envelopeContact:
+		if env.Contact == nil || env.Contact.validate() != nil {
+			log.WithField("sender", message.Sender).Warn("[webui] invalid contact card")
+			return
+		}
+		var content []byte
+		if content, err = json.Marshal(env.Contact); err != nil {
+			log.Panic(err)
+		}
+		env.Text, env.ContentType = string(content), mimeContact
+		stored, err = db.storeText(conv, env, message.SendTime, quarantine)
+	case envelopeEdit, envelopeRetract:
+		if len(env.Refs) != 1 || len(env.Refs[0]) != msgIdSize {
+			log.WithField("sender", message.Sender).Warn("[webui] invalid message revision")
+			return
+		}
+		err = db.applyRevision(conv, target, env, message.SendTime, quarantine)
+	case envelopeReaction:
+		if len(env.Refs) != 1 || len(env.Refs[0]) != msgIdSize || validateReaction(env.Reaction) != nil {
+			log.WithField("sender", message.Sender).Warn("[webui] invalid reaction")
+			return
+		}
+		if quarantine {
+			log.WithField("sender", message.Sender).Info("[webui] quarantined reaction dropped")
+			return
+		}
+		err = db.applyReaction(conv, target, env, message.SendTime)
+	default:
+		log.WithField("sender", message.Sender).Warnf("[webui] unknown envelope type %q", env.Type)
+	}
 	if err != nil {
 		log.Panic(err)
 	}
-	go web.recvMessage(target, string(message.Content), message.SendTime)
+	if stored && !quarantine {
+		if err = db.unarchive(conv); err != nil {
+			log.Panic(err)
+		}
+		if err = db.webhookReceived(conv, env, message.SendTime); err != nil {
+			log.Panic(err)
+		}
+		// answering strangers would tell them we are online
+		if conv.Group <= 0 && state == contactAccepted {
+			if err = db.autoReply(target, sender, env); err != nil {
+				log.Panic(err)
+			}
+		}
+	}
+	// group messages are not acknowledged, or the sender would get one receipt per member
+	if stored && !quarantine && env.Id != nil && conv.Group <= 0 {
+		go web.sendReceipt(target, receiptDelivered, [][]byte{env.Id})
+	}
+}
+
+func (db *database) storeText(conv conversation, env *envelope, sendTime time.Time, quarantine bool) (bool, error) {
+	var quote *quoteInfo
+	var replyRow *int64
+	if env.ReplyTo != nil {
+		var err error
+		quote, err = db.resolveQuote(conv, env.ReplyTo)
+		if err != nil {
+			return false, err
+		}
+		if quote != nil {
+			replyRow = &quote.Id
+		}
+	}
+
+	exec, err := db.Exec("INSERT OR IGNORE INTO `dec_msg` (`target`,`group`,`self`,`content`,`send_time`,`quarantine`,`msg_id`,`reply_to`,`reply_row`,`content_type`,`version`,`expire`,`expire_at`,`recv_time`) "+
+		"VALUES (?,?,FALSE,?,?,?,?,?,?,?,?,?,?,?)",
+		conv.Target, nullId(conv.Group), env.Text, sendTime.UnixMilli(), quarantine, env.Id, env.ReplyTo, replyRow, env.ContentType, env.Version,
+		env.Expire, expireAt(sendTime, env.Expire), time.Now().UnixMilli())
+	if err != nil {
+		return false, err
+	}
+	if affected, err := exec.RowsAffected(); err != nil || affected <= 0 {
+		// duplicated message ID
+		return false, err
+	}
+	id, err := exec.LastInsertId()
+	if err != nil {
+		return false, err
+	}
+
+	sender, err := db.groupSender(conv)
+	if err != nil {
+		return false, err
+	}
+
+	go web.recvMessage(conv, msgRender{
+		Id:         id,
+		Content:    env.Text,
+		Markdown:   env.ContentType == mimeMarkdown,
+		Card:       cardOf(env.ContentType, env.Text),
+		SendTime:   &sendTime,
+		Quarantine: quarantine,
+		Quote:      quote,
+		Sender:     sender,
+	})
+	return true, nil
+}
+
+// resolveQuote finds the message in a conversation by its message ID, returns nil if not found.
+func (db *database) resolveQuote(conv conversation, msgId []byte) (*quoteInfo, error) {
+	cond, arg := conv.where("")
+	row := db.QueryRow("SELECT ROWID, `self`, `content` FROM `dec_msg` WHERE "+cond+" AND `msg_id`=?", arg, msgId)
+	q := new(quoteInfo)
+	err := row.Scan(&q.Id, &q.Self, &q.Content)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return q, err
+}
+
+// getQuote returns the message in a conversation by its row ID, along with its message ID.
+func (db *database) getQuote(conv conversation, id int64) (*quoteInfo, []byte, error) {
+	cond, arg := conv.where("")
+	row := db.QueryRow("SELECT `self`, `content`, `msg_id` FROM `dec_msg` WHERE "+cond+" AND ROWID=?", arg, id)
+	q := &quoteInfo{Id: id}
+	var msgId []byte
+	err := row.Scan(&q.Self, &q.Content, &msgId)
+	if err == sql.ErrNoRows {
+		err = errors.New("replied message not found")
+	}
+	return q, msgId, err
+}
+
+// overQuota reports whether the stored messages and files take the whole storage quota. Their size is kept by
+// triggers in the storage table.
+func (db *database) overQuota() (bool, error) {
+	if db.limit.MaxStorage <= 0 {
+		return false, nil
+	}
+	var size int64
+	if err := db.QueryRow("SELECT `size` FROM `storage`").Scan(&size); err != nil {
+		return false, err
+	}
+	return size >= db.limit.MaxStorage, nil
 }
 
 func (db *database) getUserKey() ([]byte, error) {
@@ -148,7 +417,11 @@ func openDatabase(path string) (*database, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &database{DB: db}, nil
+	if err = migrate(db); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &database{DB: db, limit: getLimitConfig()}, nil
 }
 
 func createDatabase(path string, der []byte) error {
@@ -171,6 +444,9 @@ func createDatabase(path string, der []byte) error {
 	if err == nil {
 		_, err = db.Exec("INSERT INTO `user` (`rowid`, `key`) VALUES (0, ?);", der)
 	}
+	if err == nil {
+		_, err = db.Exec(fmt.Sprintf("PRAGMA user_version=%d", len(migrations)))
+	}
 
 	return err
 }
@@ -180,24 +456,150 @@ const schema = `CREATE TABLE "user"
 (
 	"rowid" INTEGER PRIMARY KEY,
 	"key" BLOB UNIQUE NOT NULL,
-	"alias" TEXT
+	"alias" TEXT,
+	"state" INTEGER DEFAULT 0 NOT NULL,
+	"receipts" BOOLEAN DEFAULT TRUE NOT NULL,
+	"expire" INTEGER DEFAULT 0 NOT NULL,
+	"verified" BOOLEAN DEFAULT FALSE NOT NULL,
+	"note" TEXT,
+	"avatar" BLOB,
+	"avatar_mime" TEXT,
+	"created" INTEGER DEFAULT (CAST(STRFTIME('%s', 'now') AS INTEGER) * 1000) NOT NULL,
+	"last_seen" INTEGER,
+	"pinned" BOOLEAN DEFAULT FALSE NOT NULL,
+	"muted" BOOLEAN DEFAULT FALSE NOT NULL,
+	"archived" BOOLEAN DEFAULT FALSE NOT NULL,
+	"previews" BOOLEAN DEFAULT TRUE NOT NULL,
+	"sync" BOOLEAN DEFAULT FALSE NOT NULL,
+	"draft" TEXT
 );
 
+CREATE TABLE "user_tag"
+(
+	"user" INTEGER NOT NULL
+		REFERENCES "user" ON UPDATE CASCADE ON DELETE CASCADE,
+	"tag" TEXT NOT NULL,
+	PRIMARY KEY ("user", "tag")
+) WITHOUT ROWID;
+
 CREATE TABLE "peer"
 (
 	"rowid" INTEGER PRIMARY KEY,
-	"id" BLOB UNIQUE NOT NULL
+	"id" BLOB UNIQUE NOT NULL,
+	"penalize" INTEGER DEFAULT 0 NOT NULL,
+	"penalized" INTEGER,
+	"url_hash" BLOB,
+	"last_seen" INTEGER,
+	"offered" INTEGER DEFAULT 0 NOT NULL,
+	"fetched" INTEGER DEFAULT 0 NOT NULL,
+	"listed" INTEGER DEFAULT 0 NOT NULL,
+	"gossiped" INTEGER DEFAULT 0 NOT NULL
 );
 
 CREATE TABLE "dec_msg"
 (
+	"rowid" INTEGER PRIMARY KEY,
 	"target" INTEGER NOT NULL
 		REFERENCES "user" ON UPDATE CASCADE ON DELETE CASCADE,
 	"self" BOOLEAN NOT NULL,
 	"content" TEXT NOT NULL,
-	"send_time" INTEGER
+	"send_time" INTEGER,
+	"quarantine" BOOLEAN DEFAULT FALSE NOT NULL,
+	"msg_id" BLOB,
+	"reply_to" BLOB,
+	"reply_row" INTEGER
+		REFERENCES "dec_msg" ON UPDATE CASCADE ON DELETE SET NULL,
+	"content_type" TEXT DEFAULT 'text/plain' NOT NULL,
+	"version" INTEGER DEFAULT 0 NOT NULL,
+	"receipt" INTEGER DEFAULT 0 NOT NULL,
+	"group" INTEGER
+		REFERENCES "group" ON UPDATE CASCADE ON DELETE CASCADE,
+	"expire" INTEGER DEFAULT 0 NOT NULL,
+	"expire_at" INTEGER,
+	"send_at" INTEGER,
+	"sending" INTEGER,
+	"edited" INTEGER,
+	"retracted" BOOLEAN DEFAULT FALSE NOT NULL,
+	"recv_time" INTEGER,
+	UNIQUE ("target", "msg_id")
+);
+
+CREATE INDEX "dec_msg_expire_at" ON "dec_msg" ("expire_at");
+
+CREATE INDEX "dec_msg_send_at" ON "dec_msg" ("send_at");
+
+CREATE TABLE "msg_edit"
+(
+	"dec_msg" INTEGER NOT NULL
+		REFERENCES "dec_msg" ON UPDATE CASCADE ON DELETE CASCADE,
+	"content" TEXT NOT NULL,
+	"content_type" TEXT NOT NULL,
+	"time" INTEGER NOT NULL
+);
+
+CREATE INDEX "msg_edit_dec_msg" ON "msg_edit" ("dec_msg");
+
+CREATE TABLE "reaction"
+(
+	"dec_msg" INTEGER NOT NULL
+		REFERENCES "dec_msg" ON UPDATE CASCADE ON DELETE CASCADE,
+	"user" INTEGER NOT NULL
+		REFERENCES "user" ON UPDATE CASCADE ON DELETE CASCADE,
+	"emoji" TEXT NOT NULL,
+	"time" INTEGER NOT NULL,
+	PRIMARY KEY ("dec_msg", "user")
+) WITHOUT ROWID;
+
+CREATE TABLE "group"
+(
+	"rowid" INTEGER PRIMARY KEY,
+	"group_id" BLOB UNIQUE NOT NULL,
+	"name" TEXT,
+	"expire" INTEGER DEFAULT 0 NOT NULL,
+	"pinned" BOOLEAN DEFAULT FALSE NOT NULL,
+	"muted" BOOLEAN DEFAULT FALSE NOT NULL,
+	"archived" BOOLEAN DEFAULT FALSE NOT NULL,
+	"draft" TEXT,
+	"creator" INTEGER
+		REFERENCES "user" ON UPDATE CASCADE ON DELETE SET NULL
+);
+
+CREATE TABLE "group_member"
+(
+	"group" INTEGER NOT NULL
+		REFERENCES "group" ON UPDATE CASCADE ON DELETE CASCADE,
+	"user" INTEGER NOT NULL
+		REFERENCES "user" ON UPDATE CASCADE ON DELETE CASCADE,
+	PRIMARY KEY ("group", "user")
+) WITHOUT ROWID;
+
+CREATE TABLE "attachment"
+(
+	"rowid" INTEGER PRIMARY KEY,
+	"target" INTEGER NOT NULL
+		REFERENCES "user" ON UPDATE CASCADE ON DELETE CASCADE,
+	"file_id" BLOB NOT NULL,
+	"msg" INTEGER
+		REFERENCES "dec_msg" ON UPDATE CASCADE ON DELETE CASCADE,
+	"name" TEXT NOT NULL,
+	"mime" TEXT NOT NULL,
+	"size" INTEGER NOT NULL,
+	"total" INTEGER NOT NULL,
+	"data" BLOB,
+	"created" INTEGER,
+	"quarantine" BOOLEAN DEFAULT FALSE NOT NULL,
+	UNIQUE ("target", "file_id")
 );
 
+CREATE TABLE "attachment_chunk"
+(
+	"attachment" INTEGER NOT NULL
+		REFERENCES "attachment" ON UPDATE CASCADE ON DELETE CASCADE,
+	"idx" INTEGER NOT NULL,
+	"data" BLOB NOT NULL,
+	PRIMARY KEY ("attachment", "idx")
+) WITHOUT ROWID;
+
 CREATE TABLE "message"
 (
 	"rowid" INTEGER PRIMARY KEY,
@@ -209,6 +611,16 @@ CREATE TABLE "message"
 	UNIQUE ("hash", "cohort")
 );
 
+CREATE TABLE "authored"
+(
+	"dec_msg" INTEGER NOT NULL
+		REFERENCES "dec_msg" ON UPDATE CASCADE ON DELETE CASCADE,
+	"message" INTEGER NOT NULL
+		REFERENCES "message" ON UPDATE CASCADE ON DELETE CASCADE,
+	"trace" BOOLEAN DEFAULT FALSE NOT NULL,
+	PRIMARY KEY ("dec_msg", "message")
+) WITHOUT ROWID;
+
 CREATE TABLE "peer_link"
 (
 	"url_hash" BLOB PRIMARY KEY,
@@ -232,4 +644,81 @@ CREATE TABLE "known_peer"
 		REFERENCES "peer" ON UPDATE CASCADE ON DELETE CASCADE,
 	"url_hash" BLOB NOT NULL,
 	PRIMARY KEY ("peer_id", "url_hash")
-) WITHOUT ROWID;`
+) WITHOUT ROWID;
+
+CREATE TABLE "auto_reply"
+(
+	"rowid" INTEGER PRIMARY KEY,
+	"sender" TEXT,
+	"content" TEXT,
+	"reply" TEXT NOT NULL,
+	"enabled" BOOLEAN DEFAULT TRUE NOT NULL
+);
+
+CREATE TABLE "webhook_delivery"
+(
+	"rowid" INTEGER PRIMARY KEY,
+	"url" TEXT NOT NULL,
+	"event" TEXT NOT NULL,
+	"payload" BLOB NOT NULL,
+	"created" INTEGER NOT NULL,
+	"attempts" INTEGER DEFAULT 0 NOT NULL,
+	"next_attempt" INTEGER,
+	"status" INTEGER,
+	"error" TEXT,
+	"delivered" INTEGER
+);
+
+CREATE INDEX "webhook_delivery_next_attempt" ON "webhook_delivery" ("next_attempt");
+
+CREATE TABLE "storage"
+(
+	"size" INTEGER NOT NULL
+);
+
+INSERT INTO "storage" VALUES (0);
+
+CREATE TRIGGER "message_storage_insert" AFTER INSERT ON "message"
+BEGIN
+	UPDATE "storage" SET "size"="size"+IFNULL(LENGTH(NEW."msg"), 0);
+END;
+
+CREATE TRIGGER "message_storage_update" AFTER UPDATE OF "msg" ON "message"
+BEGIN
+	UPDATE "storage" SET "size"="size"+IFNULL(LENGTH(NEW."msg"), 0)-IFNULL(LENGTH(OLD."msg"), 0);
+END;
+
+CREATE TRIGGER "message_storage_delete" AFTER DELETE ON "message"
+BEGIN
+	UPDATE "storage" SET "size"="size"-IFNULL(LENGTH(OLD."msg"), 0);
+END;
+
+CREATE TRIGGER "attachment_storage_insert" AFTER INSERT ON "attachment"
+BEGIN
+	UPDATE "storage" SET "size"="size"+IFNULL(LENGTH(NEW."data"), 0);
+END;
+
+CREATE TRIGGER "attachment_storage_update" AFTER UPDATE OF "data" ON "attachment"
+BEGIN
+	UPDATE "storage" SET "size"="size"+IFNULL(LENGTH(NEW."data"), 0)-IFNULL(LENGTH(OLD."data"), 0);
+END;
+
+CREATE TRIGGER "attachment_storage_delete" AFTER DELETE ON "attachment"
+BEGIN
+	UPDATE "storage" SET "size"="size"-IFNULL(LENGTH(OLD."data"), 0);
+END;
+
+CREATE TRIGGER "attachment_chunk_storage_insert" AFTER INSERT ON "attachment_chunk"
+BEGIN
+	UPDATE "storage" SET "size"="size"+IFNULL(LENGTH(NEW."data"), 0);
+END;
+
+CREATE TRIGGER "attachment_chunk_storage_update" AFTER UPDATE OF "data" ON "attachment_chunk"
+BEGIN
+	UPDATE "storage" SET "size"="size"+IFNULL(LENGTH(NEW."data"), 0)-IFNULL(LENGTH(OLD."data"), 0);
+END;
+
+CREATE TRIGGER "attachment_chunk_storage_delete" AFTER DELETE ON "attachment_chunk"
+BEGIN
+	UPDATE "storage" SET "size"="size"-IFNULL(LENGTH(OLD."data"), 0);
+END;`
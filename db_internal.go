@@ -1,9 +1,17 @@
 package main
 
-import "database/sql"
+import (
+	"database/sql"
+	"strings"
+)
 
-func insertOrIgnore(db *sql.DB, ins, sel string, arg interface{}) (uint, bool, error) {
-	exec, err := db.Exec(ins, arg)
+// sqlIn returns the placeholder list of an IN clause with n values.
+func sqlIn(n int) string {
+	return "(" + strings.Repeat("?,", n-1) + "?)"
+}
+
+func insertOrIgnore(db *sql.DB, ins, sel string, arg interface{}, extra ...interface{}) (uint, bool, error) {
+	exec, err := db.Exec(ins, append([]interface{}{arg}, extra...)...)
 	if err != nil {
 		return 0, false, err
 	}
@@ -25,12 +33,35 @@ func insertOrIgnore(db *sql.DB, ins, sel string, arg interface{}) (uint, bool, e
 	return id, false, err
 }
 
-func (db *database) lookupUserId(key []byte) (uint, error) {
+const (
+	contactAccepted = iota
+	contactRequest
+	contactBlocked
+)
+
+func (db *database) lookupUserId(key []byte, state int) (uint, error) {
 	id, inserted, err := insertOrIgnore(db.DB,
-		"INSERT OR IGNORE INTO `user` (`key`) VALUES (?)",
-		"SELECT `rowid` FROM `user` WHERE `key`=?", key)
+		"INSERT OR IGNORE INTO `user` (`key`,`state`) VALUES (?,?)",
+		"SELECT `rowid` FROM `user` WHERE `key`=?", key, state)
 	if inserted {
-		web.newUser(id, key)
+		web.newUser(id, key, state)
 	}
 	return id, err
 }
+
+func (db *database) getUserState(id uint) (state int, err error) {
+	row := db.QueryRow("SELECT `state` FROM `user` WHERE `rowid`=?", id)
+	if row.Err() != nil {
+		return 0, row.Err()
+	}
+	err = row.Scan(&state)
+	return
+}
+
+// nullId maps the zero row ID to NULL.
+func nullId(id uint) interface{} {
+	if id <= 0 {
+		return nil
+	}
+	return id
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+type deleteMessage struct {
+	conversation
+	Id int64 `json:"id"`
+}
+
+type msgDeleted struct {
+	conversation
+	Ids []int64 `json:"ids"`
+}
+
+// deleteMessages deletes dec_msg rows of a conversation, and notifies the clients.
+func (w *webui) deleteMessages(conv conversation, ids []int64) error {
+	if len(ids) <= 0 {
+		return nil
+	}
+
+	cond, arg := conv.where("")
+	args := []interface{}{arg}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	_, err := w.db.Exec("DELETE FROM `dec_msg` WHERE "+cond+" AND ROWID IN "+sqlIn(len(ids)), args...)
+	if err != nil {
+		return err
+	}
+
+	go w.broadcast("msg_deleted", msgDeleted{conversation: conv, Ids: ids})
+	return nil
+}
+
+func (w *webui) deleteMessage(msg json.RawMessage) error {
+	var nm deleteMessage
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+	return w.deleteMessages(nm.conversation, []int64{nm.Id})
+}
+
+// clearConversation deletes the whole history of a conversation.
+func (w *webui) clearConversation(msg json.RawMessage) error {
+	conv, err := parseConversation(msg)
+	if err != nil {
+		return err
+	}
+
+	cond, arg := conv.where("")
+	_, err = w.db.Exec("DELETE FROM `dec_msg` WHERE "+cond, arg)
+	if err != nil {
+		return err
+	}
+
+	go w.broadcast("cleared", conv)
+	return nil
+}
+
+// deleteContact deletes a contact along with its history, including the messages it wrote in groups.
+func (w *webui) deleteContact(msg json.RawMessage) error {
+	var id uint
+	if err := json.Unmarshal(msg, &id); err != nil {
+		return err
+	}
+	if id <= 0 {
+		return errors.New("invalid contact id")
+	}
+
+	groups, err := w.db.memberOf(id)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.db.Exec("DELETE FROM `user` WHERE `rowid`=?", id)
+	if err != nil {
+		return err
+	}
+
+	go w.broadcast("contact_deleted", id)
+	for _, g := range groups {
+		go w.groupChanged(g)
+	}
+	return nil
+}
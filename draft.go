@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+const maxDraftLength = 64 << 10
+
+// setDraft is the unsent composer text of a conversation, empty if there is none.
+type setDraft struct {
+	conversation
+	Draft string `json:"draft"`
+}
+
+func (db *database) getDraft(conv conversation) (draft string, err error) {
+	table, id := conv.table()
+	err = db.QueryRow("SELECT IFNULL(`draft`, '') FROM "+table+" WHERE `rowid`=?", id).Scan(&draft)
+	return
+}
+
+// updateDraft stores the draft of a conversation, and notifies the clients if it changed.
+func (w *webui) updateDraft(conv conversation, draft string) error {
+	var arg interface{}
+	if strings.TrimSpace(draft) != "" {
+		arg = draft
+	} else {
+		draft = ""
+	}
+
+	table, id := conv.table()
+	exec, err := w.db.Exec("UPDATE "+table+" SET `draft`=? WHERE `rowid`=? AND `rowid`>0 AND `draft` IS NOT ?", arg, id, arg)
+	if err != nil {
+		return err
+	}
+	if affected, err := exec.RowsAffected(); err != nil || affected <= 0 {
+		return err
+	}
+
+	if conv.Group > 0 {
+		conv.Target = 0
+	}
+	go w.broadcast("draft", setDraft{conversation: conv, Draft: draft})
+	return nil
+}
+
+func (w *webui) setDraft(msg json.RawMessage) error {
+	var nm setDraft
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+	if len(nm.Draft) > maxDraftLength {
+		return errors.New("draft too long")
+	}
+	return w.updateDraft(nm.conversation, nm.Draft)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/nymo-net/nymo"
+)
+
+type editMessage struct {
+	conversation
+	Id       int64  `json:"id"`
+	Message  string `json:"message,omitempty"`
+	Markdown bool   `json:"markdown,omitempty"`
+}
+
+// msgVersion is a version of an edited message, Time being when it was written.
+type msgVersion struct {
+	Content  string `json:"content"`
+	Markdown bool   `json:"markdown,omitempty"`
+	Time     int64  `json:"time"`
+}
+
+type msgEdits struct {
+	Id       int64        `json:"id"`
+	Versions []msgVersion `json:"versions"`
+}
+
+// replaceContent replaces the content of a message, keeping the former one in its edit history. A retraction
+// clears the content along with the history and any attachment.
+func (db *database) replaceContent(id int64, text, contentType string, retract bool, at time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if retract {
+		if _, err = tx.Exec("DELETE FROM `msg_edit` WHERE `dec_msg`=?", id); err != nil {
+			return err
+		}
+		if _, err = tx.Exec("DELETE FROM `attachment` WHERE `msg`=?", id); err != nil {
+			return err
+		}
+		text, contentType = "", mimeText
+	} else {
+		_, err = tx.Exec("INSERT INTO `msg_edit` (`dec_msg`,`content`,`content_type`,`time`) "+
+			"SELECT ROWID, `content`, `content_type`, COALESCE(`edited`, `send_time`, 0) FROM `dec_msg` WHERE ROWID=?", id)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("UPDATE `dec_msg` SET `content`=?, `content_type`=?, `retracted`=?, `edited`=? WHERE ROWID=?",
+		text, contentType, retract, at.UnixMilli(), id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// applyRevision applies an edit or retraction from the sender of a message. Revisions of unknown messages, and ones
+// older than the latest applied, are ignored.
+func (db *database) applyRevision(conv conversation, target uint, env *envelope, sendTime time.Time, quarantine bool) error {
+	retract := env.Type == envelopeRetract
+	cond, arg := conv.where("")
+	var id int64
+	err := db.QueryRow("SELECT ROWID FROM `dec_msg` WHERE "+cond+" AND `target`=? AND NOT `self` AND `msg_id`=? "+
+		"AND NOT `retracted` AND (`edited` IS NULL OR `edited`<?) AND (? OR ROWID NOT IN (SELECT `msg` FROM `attachment` WHERE `msg` IS NOT NULL))",
+		arg, target, env.Refs[0], sendTime.UnixMilli(), retract).Scan(&id)
+	if err == sql.ErrNoRows {
+		log.WithField("target", target).Debug("[webui] revision of unknown message ignored")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err = db.replaceContent(id, env.Text, env.ContentType, retract, sendTime); err != nil {
+		return err
+	}
+	if quarantine {
+		if _, err = db.Exec("UPDATE `dec_msg` SET `quarantine`=TRUE WHERE ROWID=?", id); err != nil {
+			return err
+		}
+	}
+
+	go web.msgChanged("msg_edited", conv, id)
+	return nil
+}
+
+// reviseMessage edits (or retracts) a message we sent, and sends the revision to its receivers.
+func (w *webui) reviseMessage(nm *editMessage, retract bool) error {
+	env, err := newEnvelope(envelopeEdit)
+	if err != nil {
+		return err
+	}
+	if retract {
+		env.Type = envelopeRetract
+	} else {
+		nm.Message = strings.TrimSpace(nm.Message)
+		if nm.Message == "" {
+			return errors.New("empty message")
+		}
+		env.Text, env.ContentType = nm.Message, mimeText
+		if nm.Markdown {
+			env.ContentType = mimeMarkdown
+		}
+	}
+
+	conv := nm.conversation
+	cond, arg := conv.where("")
+	var msgId []byte
+	err = w.db.QueryRow("SELECT `msg_id` FROM `dec_msg` WHERE "+cond+" AND ROWID=? AND `self` AND `send_time` IS NOT NULL "+
+		"AND `msg_id` IS NOT NULL AND NOT `retracted` AND (? OR ROWID NOT IN (SELECT `msg` FROM `attachment` WHERE `msg` IS NOT NULL) "+
+		"AND `content_type`<>'"+mimeContact+"')",
+		arg, nm.Id, retract).Scan(&msgId)
+	if err == sql.ErrNoRows {
+		return errors.New("message cannot be changed")
+	} else if err != nil {
+		return err
+	}
+	env.Refs = [][]byte{msgId}
+
+	var addresses []*nymo.Address
+	if conv.Group > 0 {
+		env.Group, addresses, err = w.lookupGroup(conv.Group)
+	} else {
+		var address *nymo.Address
+		_, address, err = w.lookupTargetId(conv.Target)
+		addresses = []*nymo.Address{address}
+	}
+	if err != nil {
+		return err
+	}
+	payload, err := env.marshal()
+	if err != nil {
+		return err
+	}
+
+	if retract {
+		// stop relaying what was sent so far
+		if err = w.db.dropAuthored([]int64{nm.Id}); err != nil {
+			return err
+		}
+	}
+	if err = w.db.replaceContent(nm.Id, env.Text, env.ContentType, retract, time.Now()); err != nil {
+		return err
+	}
+
+	go func() {
+		w.msgChanged("msg_edited", conv, nm.Id)
+		for _, address := range addresses {
+			// authored by the message, so the revision expires along with it
+			if err := w.sendPayload(address, payload, nm.Id); err != nil {
+				log.Warnf("[webui] sending revision: %s", err)
+				w.broadcast("err", "Sending the change failed: "+err.Error())
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (w *webui) editMessage(msg json.RawMessage) error {
+	var nm editMessage
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+	return w.reviseMessage(&nm, false)
+}
+
+func (w *webui) retractMessage(msg json.RawMessage) error {
+	var nm editMessage
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+	return w.reviseMessage(&nm, true)
+}
+
+// getEdits returns the versions of a message, the current one last.
+func (w *webui) getEdits(msg json.RawMessage) (*msgEdits, error) {
+	ret := new(msgEdits)
+	if err := json.Unmarshal(msg, &ret.Id); err != nil {
+		return nil, err
+	}
+
+	query, err := w.db.Query("SELECT `content`, `content_type`, `time` FROM `msg_edit` WHERE `dec_msg`=? ORDER BY `time`, ROWID", ret.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+
+	for query.Next() {
+		var v msgVersion
+		var contentType string
+		if err = query.Scan(&v.Content, &contentType, &v.Time); err != nil {
+			return nil, err
+		}
+		v.Markdown = contentType == mimeMarkdown
+		ret.Versions = append(ret.Versions, v)
+	}
+	if err = query.Err(); err != nil {
+		return nil, err
+	}
+
+	var v msgVersion
+	var contentType string
+	err = w.db.QueryRow("SELECT `content`, `content_type`, COALESCE(`edited`, `send_time`, 0) FROM `dec_msg` WHERE ROWID=? AND NOT `retracted`",
+		ret.Id).Scan(&v.Content, &contentType, &v.Time)
+	if err == sql.ErrNoRows {
+		return ret, nil
+	} else if err != nil {
+		return nil, err
+	}
+	v.Markdown = contentType == mimeMarkdown
+	ret.Versions = append(ret.Versions, v)
+	return ret, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseRevision(t *testing.T) {
+	for _, typ := range []string{envelopeEdit, envelopeRetract} {
+		env, err := newEnvelope(typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := newMessageId()
+		if err != nil {
+			t.Fatal(err)
+		}
+		env.Refs, env.Text, env.ContentType = [][]byte{ref}, "fixed", mimeMarkdown
+		payload, err := env.marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := parsePayload(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Type != typ || len(got.Refs) != 1 || !bytes.Equal(got.Refs[0], ref) || got.Text != "fixed" || got.ContentType != mimeMarkdown {
+			t.Errorf("%s: parsed %+v", typ, got)
+		}
+	}
+}
+
+// revisionDatabase returns a database with a message received from user 1 (row 1), and one sent to it (row 2).
+func revisionDatabase(t *testing.T) *database {
+	t.Helper()
+	db := testDatabase(t)
+	_, err := db.Exec("INSERT INTO `user` (`rowid`, `key`) VALUES (0, x'00'), (1, x'01');" +
+		"INSERT INTO `dec_msg` (`target`, `self`, `content`, `send_time`, `msg_id`) VALUES " +
+		"(1, FALSE, 'typo', 1000, x'01'), (1, TRUE, 'ours', 1000, x'02')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestReplaceContent(t *testing.T) {
+	db := revisionDatabase(t)
+	w := &webui{db: db}
+	for i, text := range []string{"second", "third"} {
+		if err := db.replaceContent(1, text, mimeMarkdown, false, time.UnixMilli(int64(2000+i*1000))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	edits, err := w.getEdits(json.RawMessage("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []msgVersion{{"typo", false, 1000}, {"second", true, 2000}, {"third", true, 3000}}
+	if len(edits.Versions) != len(want) {
+		t.Fatalf("versions %+v, want %+v", edits.Versions, want)
+	}
+	for i, v := range edits.Versions {
+		if v != want[i] {
+			t.Errorf("version %d: %+v, want %+v", i, v, want[i])
+		}
+	}
+
+	if err = db.replaceContent(1, "", mimeText, true, time.UnixMilli(4000)); err != nil {
+		t.Fatal(err)
+	}
+	if edits, err = w.getEdits(json.RawMessage("1")); err != nil {
+		t.Fatal(err)
+	}
+	if len(edits.Versions) > 0 {
+		t.Errorf("retracted message keeps versions %+v", edits.Versions)
+	}
+	var content string
+	var retracted bool
+	if err = db.QueryRow("SELECT `content`, `retracted` FROM `dec_msg` WHERE ROWID=1").Scan(&content, &retracted); err != nil {
+		t.Fatal(err)
+	}
+	if content != "" || !retracted {
+		t.Errorf("retracted message has content %q, retracted %v", content, retracted)
+	}
+}
+
+func TestApplyRevisionIgnored(t *testing.T) {
+	db := revisionDatabase(t)
+	if err := db.replaceContent(1, "edited", mimeText, false, time.UnixMilli(3000)); err != nil {
+		t.Fatal(err)
+	}
+	conv := conversation{Target: 1}
+
+	tests := []struct {
+		name string
+		conv conversation
+		ref  []byte
+		at   int64
+	}{
+		{"unknown message", conv, []byte{9}, 4000},
+		{"our message", conv, []byte{2}, 4000},
+		{"older than the last edit", conv, []byte{1}, 2000},
+		{"other conversation", conversation{Target: 2}, []byte{1}, 4000},
+	}
+	for _, test := range tests {
+		env := &envelope{Version: envelopeVersion, Type: envelopeEdit, Refs: [][]byte{test.ref}, Text: "ignored", ContentType: mimeText}
+		if err := db.applyRevision(test.conv, test.conv.Target, env, time.UnixMilli(test.at), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for id, want := range map[int64]string{1: "edited", 2: "ours"} {
+		var content string
+		if err := db.QueryRow("SELECT `content` FROM `dec_msg` WHERE ROWID=?", id).Scan(&content); err != nil {
+			t.Fatal(err)
+		}
+		if content != want {
+			t.Errorf("message %d revised to %q, want %q", id, content, want)
+		}
+	}
+}
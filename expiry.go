@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	sweepInterval = 10 * time.Second
+	maxExpiry     = 365 * 24 * 60 * 60 // in seconds
+
+	maxDeleteBatch = 500
+)
+
+// setExpiry is the disappearing message timer of a conversation in seconds, 0 if disabled.
+type setExpiry struct {
+	conversation
+	Expire uint `json:"expire"`
+}
+
+// expireAt returns the deletion time of a message sent at t, or nil if it does not expire.
+func expireAt(t time.Time, expire uint) interface{} {
+	if expire <= 0 {
+		return nil
+	}
+	return t.Add(time.Duration(expire) * time.Second).UnixMilli()
+}
+
+func (db *database) getExpiry(conv conversation) (expire uint, err error) {
+	row := db.QueryRow("SELECT `expire` FROM `user` WHERE `rowid`=?", conv.Target)
+	if conv.Group > 0 {
+		row = db.QueryRow("SELECT `expire` FROM `group` WHERE `rowid`=?", conv.Group)
+	}
+	err = row.Scan(&expire)
+	return
+}
+
+func (db *database) updateExpiry(conv conversation, expire uint) (bool, error) {
+	var err error
+	var exec sql.Result
+	if conv.Group > 0 {
+		exec, err = db.Exec("UPDATE `group` SET `expire`=? WHERE `rowid`=? AND `expire`!=?", expire, conv.Group, expire)
+	} else {
+		exec, err = db.Exec("UPDATE `user` SET `expire`=? WHERE `rowid`=? AND `rowid`>0 AND `expire`!=?", expire, conv.Target, expire)
+	}
+	if err != nil {
+		return false, err
+	}
+	affected, err := exec.RowsAffected()
+	return affected > 0, err
+}
+
+// syncExpiry adopts the timer of a received message, so both sides of a conversation use the same one.
+// Messages delivered out of order do not override the timer of newer ones.
+func (db *database) syncExpiry(conv conversation, expire uint, sendTime time.Time) error {
+	cond, arg := conv.where("")
+	row := db.QueryRow("SELECT COUNT(*) FROM `dec_msg` WHERE "+cond+" AND NOT `self` AND `send_time`>?", arg, sendTime.UnixMilli())
+	var newer int
+	if err := row.Scan(&newer); err != nil || newer > 0 {
+		return err
+	}
+
+	changed, err := db.updateExpiry(conv, expire)
+	if err != nil || !changed {
+		return err
+	}
+	if conv.Group > 0 {
+		conv.Target = 0
+	}
+	go web.broadcast("expiry", setExpiry{conversation: conv, Expire: expire})
+	return nil
+}
+
+func (w *webui) setExpiry(msg json.RawMessage) error {
+	var nm setExpiry
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+	if nm.Expire > maxExpiry {
+		return errors.New("expiry too long")
+	}
+
+	if _, err := w.db.updateExpiry(nm.conversation, nm.Expire); err != nil {
+		return err
+	}
+
+	go w.broadcast("expiry", nm)
+	return nil
+}
+
+// dropAuthored deletes the stored message blobs we sent for the given dec_msg rows, so they are not relayed anymore.
+func (db *database) dropAuthored(ids []int64) error {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	_, err := db.Exec("UPDATE `message` SET `msg`=NULL, `deleted`=TRUE "+
+		"WHERE `rowid` IN (SELECT `message` FROM `authored` WHERE `dec_msg` IN "+sqlIn(len(ids))+")", args...)
+	return err
+}
+
+func (w *webui) sweepExpired() error {
+	query, err := w.db.Query("SELECT ROWID, `target`, IFNULL(`group`, 0) FROM `dec_msg` WHERE `expire_at`<=?",
+		time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	expired := make(map[conversation][]int64)
+	for query.Next() {
+		var id int64
+		var conv conversation
+		if err = query.Scan(&id, &conv.Target, &conv.Group); err != nil {
+			_ = query.Close()
+			return err
+		}
+		if conv.Group > 0 {
+			conv.Target = 0
+		}
+		expired[conv] = append(expired[conv], id)
+	}
+	if err = query.Err(); err != nil {
+		return err
+	}
+
+	for conv, ids := range expired {
+		for len(ids) > 0 {
+			batch := ids
+			if len(batch) > maxDeleteBatch {
+				batch = batch[:maxDeleteBatch]
+			}
+			ids = ids[len(batch):]
+			if err = w.db.dropAuthored(batch); err != nil {
+				return err
+			}
+			if err = w.deleteMessages(conv, batch); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runSweeper deletes expired messages and incomplete files periodically until ctx is done.
+func (w *webui) runSweeper(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.sweepExpired(); err != nil {
+			log.Errorf("[webui, db] sweeping expired messages: %s", err)
+		}
+		if err := w.db.sweepIncomplete(); err != nil {
+			log.Errorf("[webui, db] sweeping incomplete files: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+
+	"github.com/nymo-net/nymo"
+)
+
+type filterAction int
+
+const (
+	filterPass filterAction = iota
+	filterQuarantine
+	filterDrop
+)
+
+type messageFilter struct {
+	sender  []byte
+	content *regexp.Regexp
+	larger  int
+	smaller int
+	action  filterAction
+}
+
+var filters []messageFilter
+
+func compileFilters() error {
+	for i, f := range config.Filter {
+		var mf messageFilter
+		if f.Sender != "" {
+			addr := nymo.NewAddress(f.Sender)
+			if addr == nil {
+				return fmt.Errorf("filter #%d: invalid sender address", i)
+			}
+			mf.sender = addr.Bytes()
+		}
+		if f.Content != "" {
+			var err error
+			mf.content, err = regexp.Compile(f.Content)
+			if err != nil {
+				return fmt.Errorf("filter #%d: %w", i, err)
+			}
+		}
+		mf.larger, mf.smaller = f.LargerThan, f.SmallerThan
+
+		switch f.Action {
+		case "drop":
+			mf.action = filterDrop
+		case "quarantine":
+			mf.action = filterQuarantine
+		default:
+			return fmt.Errorf("filter #%d: unknown action %q", i, f.Action)
+		}
+		filters = append(filters, mf)
+	}
+	return nil
+}
+
+func (f *messageFilter) match(sender []byte, content string, size int, hasContent bool) bool {
+	if f.sender != nil && !bytes.Equal(f.sender, sender) {
+		return false
+	}
+	if !hasContent {
+		// content conditions never match messages without content
+		return f.content == nil && f.larger <= 0 && f.smaller <= 0
+	}
+	if f.content != nil && !f.content.MatchString(content) {
+		return false
+	}
+	if f.larger > 0 && size <= f.larger {
+		return false
+	}
+	if f.smaller > 0 && size >= f.smaller {
+		return false
+	}
+	return true
+}
+
+// filterContent returns what the filters look at in a message: the text, or the name and size of a file. Control
+// messages (receipts, reactions and the like) have no content.
+func filterContent(env *envelope) (content string, size int, ok bool) {
+	switch env.Type {
+	case envelopeText, envelopeEdit:
+		return env.Text, len(env.Text), true
+	case envelopeContact:
+		if env.Contact == nil {
+			return "", 0, false
+		}
+		return env.Contact.Name, len(env.Contact.Name), true
+	case envelopeFile:
+		if env.File == nil {
+			return "", 0, false
+		}
+		return env.File.Name, int(env.File.Size), true
+	default:
+		return "", 0, false
+	}
+}
+
+// applyFilters returns the action of the first filter matching the message.
+func applyFilters(sender []byte, env *envelope) filterAction {
+	content, size, ok := filterContent(env)
+	for i := range filters {
+		if filters[i].match(sender, content, size, ok) {
+			return filters[i].action
+		}
+	}
+	return filterPass
+}
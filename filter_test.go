@@ -0,0 +1,114 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+// useFilters compiles the filters of a TOML configuration for the test.
+func useFilters(t *testing.T, conf string) error {
+	t.Helper()
+	oldConfig, oldFilters := config.Filter, filters
+	t.Cleanup(func() { config.Filter, filters = oldConfig, oldFilters })
+
+	config.Filter, filters = nil, nil
+	if _, err := toml.Decode(conf, &config); err != nil {
+		t.Fatal(err)
+	}
+	return compileFilters()
+}
+
+func TestCompileFilters(t *testing.T) {
+	for _, conf := range []string{
+		"[[filter]]\nsender = \"nymo://invalid\"\naction = \"drop\"",
+		"[[filter]]\ncontent = \"(\"\naction = \"drop\"",
+		"[[filter]]\ncontent = \"spam\"\naction = \"delete\"",
+		"[[filter]]\ncontent = \"spam\"",
+	} {
+		if err := useFilters(t, conf); err == nil {
+			t.Errorf("compiled invalid filter %q", conf)
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	addr := testAddress(t)
+	other := []byte("someone else")
+
+	tests := []struct {
+		name       string
+		filter     messageFilter
+		sender     []byte
+		content    string
+		size       int
+		hasContent bool
+		match      bool
+	}{
+		{"empty matches all", messageFilter{}, other, "hi", 2, true, true},
+		{"empty matches control", messageFilter{}, other, "", 0, false, true},
+		{"sender", messageFilter{sender: addr.Bytes()}, addr.Bytes(), "hi", 2, true, true},
+		{"other sender", messageFilter{sender: addr.Bytes()}, other, "hi", 2, true, false},
+		{"sender matches control", messageFilter{sender: addr.Bytes()}, addr.Bytes(), "", 0, false, true},
+		{"content", messageFilter{content: regexp.MustCompile(`(?i)free money`)}, other, "FREE MONEY now", 14, true, true},
+		{"other content", messageFilter{content: regexp.MustCompile(`(?i)free money`)}, other, "hello", 5, true, false},
+		{"content skips control", messageFilter{content: regexp.MustCompile(``)}, other, "", 0, false, false},
+		{"larger", messageFilter{larger: 10}, other, "", 11, true, true},
+		{"not larger", messageFilter{larger: 10}, other, "", 10, true, false},
+		{"smaller", messageFilter{smaller: 10}, other, "", 9, true, true},
+		{"not smaller", messageFilter{smaller: 10}, other, "", 10, true, false},
+		{"size skips control", messageFilter{smaller: 10}, other, "", 0, false, false},
+		{"all conditions", messageFilter{sender: addr.Bytes(), content: regexp.MustCompile(`^x`), larger: 1, smaller: 5},
+			addr.Bytes(), "xyz", 3, true, true},
+		{"one condition fails", messageFilter{sender: addr.Bytes(), content: regexp.MustCompile(`^x`), larger: 1, smaller: 5},
+			addr.Bytes(), "xyzzy", 5, true, false},
+	}
+	for _, test := range tests {
+		if got := test.filter.match(test.sender, test.content, test.size, test.hasContent); got != test.match {
+			t.Errorf("%s: match %v, want %v", test.name, got, test.match)
+		}
+	}
+}
+
+func TestApplyFilters(t *testing.T) {
+	err := useFilters(t, `
+[[filter]]
+content = "^spam"
+action = "drop"
+
+[[filter]]
+larger_than = 1000
+action = "quarantine"
+
+[[filter]]
+content = "spam"
+action = "quarantine"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := []byte("sender")
+
+	tests := []struct {
+		name   string
+		env    *envelope
+		action filterAction
+	}{
+		{"plain text", &envelope{Type: envelopeText, Text: "hello"}, filterPass},
+		{"first filter wins", &envelope{Type: envelopeText, Text: "spam spam"}, filterDrop},
+		{"later filter", &envelope{Type: envelopeText, Text: "no spam"}, filterQuarantine},
+		{"edit", &envelope{Type: envelopeEdit, Text: "spam"}, filterDrop},
+		{"file name", &envelope{Type: envelopeFile, File: &fileChunk{Name: "spam.exe", Size: 10}}, filterDrop},
+		{"file size", &envelope{Type: envelopeFile, File: &fileChunk{Name: "big.bin", Size: 2000}}, filterQuarantine},
+		{"contact name", &envelope{Type: envelopeContact, Contact: &contactCard{Name: "spammer"}}, filterDrop},
+		{"receipt", &envelope{Type: envelopeReceipt, Receipt: receiptRead}, filterPass},
+		{"reaction", &envelope{Type: envelopeReaction, Reaction: "👍"}, filterPass},
+		{"file without chunk", &envelope{Type: envelopeFile}, filterPass},
+	}
+	for _, test := range tests {
+		if got := applyFilters(sender, test.env); got != test.action {
+			t.Errorf("%s: action %d, want %d", test.name, got, test.action)
+		}
+	}
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/nymo-net/nymo"
+)
+
+const maxGroupMembers = 64
+
+// conversation identifies either a contact or a group.
+type conversation struct {
+	Target uint `json:"target,omitempty"`
+	Group  uint `json:"group,omitempty"`
+}
+
+func parseConversation(msg json.RawMessage) (c conversation, err error) {
+	if err = json.Unmarshal(msg, &c.Target); err == nil {
+		return
+	}
+	err = json.Unmarshal(msg, &c)
+	return
+}
+
+// where returns the condition selecting the dec_msg rows (of the given table alias) of the conversation, and its argument.
+// Messages of a group are in the group conversation regardless of their sender.
+func (c conversation) where(table string) (string, interface{}) {
+	if c.Group > 0 {
+		return table + "`group`=?", c.Group
+	}
+	return table + "`group` IS NULL AND " + table + "`target`=?", c.Target
+}
+
+// groupInfo is carried by every group message, so recipients can thread it. Only the creator can change the members.
+type groupInfo struct {
+	Id      []byte   `json:"id"`
+	Name    string   `json:"name,omitempty"`
+	Members [][]byte `json:"members"`
+	Creator []byte   `json:"creator,omitempty"`
+}
+
+func (g *groupInfo) validate() error {
+	if len(g.Id) != msgIdSize {
+		return errors.New("invalid group id")
+	}
+	if len(g.Members) > maxGroupMembers {
+		return errors.New("too many group members")
+	}
+	for _, m := range g.Members {
+		if nymo.NewAddressFromBytes(m) == nil {
+			return errors.New("invalid group member")
+		}
+	}
+	return nil
+}
+
+func (g *groupInfo) hasMember(key []byte) bool {
+	for _, m := range g.Members {
+		if bytes.Equal(m, key) {
+			return true
+		}
+	}
+	return false
+}
+
+type groupUpdate struct {
+	Id      uint   `json:"id"`
+	Name    string `json:"name"`
+	Members []uint `json:"members"`
+}
+
+// getGroup returns the group info of a group (with ourselves as member) and the addresses of the other members.
+func (db *database) getGroup(group uint) (*groupInfo, []*nymo.Address, error) {
+	info := &groupInfo{Members: [][]byte{web.user.Address().Bytes()}}
+	var name *string
+	var creator *uint
+	row := db.QueryRow("SELECT `group_id`, `name`, `creator` FROM `group` WHERE `rowid`=?", group)
+	if err := row.Scan(&info.Id, &name, &creator); err != nil {
+		return nil, nil, err
+	}
+	if name != nil {
+		info.Name = *name
+	}
+	if creator != nil && *creator <= 0 {
+		info.Creator = web.user.Address().Bytes()
+	} else if creator != nil {
+		if err := db.QueryRow("SELECT `key` FROM `user` WHERE `rowid`=?", *creator).Scan(&info.Creator); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	query, err := db.Query("SELECT `key` FROM `group_member` JOIN `user` ON `user`=`rowid` WHERE `group`=?", group)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer query.Close()
+
+	var addresses []*nymo.Address
+	for query.Next() {
+		var key []byte
+		if err = query.Scan(&key); err != nil {
+			return nil, nil, err
+		}
+		address := nymo.NewAddressFromBytes(key)
+		if address == nil {
+			log.Fatal("[webui, db] invalid member address")
+		}
+		info.Members = append(info.Members, key)
+		addresses = append(addresses, address)
+	}
+	return info, addresses, query.Err()
+}
+
+// lookupGroup resolves a group to send to.
+func (w *webui) lookupGroup(group uint) (*groupInfo, []*nymo.Address, error) {
+	info, addresses, err := w.db.getGroup(group)
+	if err == sql.ErrNoRows {
+		return nil, nil, errors.New("unknown group")
+	}
+	if err == nil && len(addresses) <= 0 {
+		err = errors.New("group has no members")
+	}
+	return info, addresses, err
+}
+
+// setMembers replaces the members of a group with the given user IDs.
+func setMembers(tx *sql.Tx, group uint, members []uint) error {
+	_, err := tx.Exec("DELETE FROM `group_member` WHERE `group`=?", group)
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		_, err = tx.Exec("INSERT OR IGNORE INTO `group_member` VALUES (?,?)", group, m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *webui) checkMembers(members []uint) error {
+	if len(members) <= 0 {
+		return errors.New("group has no members")
+	}
+	if len(members) >= maxGroupMembers {
+		return errors.New("too many group members")
+	}
+	for _, m := range members {
+		if _, err := w.db.lookupAddress(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupCreator returns the user ID of the creator of a group, 0 for ourselves. It returns false if the creator is
+// unknown (the group is from before creators were recorded, or the creator was deleted), and any member can then
+// change the group.
+func (db *database) groupCreator(group uint) (uint, bool, error) {
+	var creator *uint
+	if err := db.QueryRow("SELECT `creator` FROM `group` WHERE `rowid`=?", group).Scan(&creator); err != nil {
+		return 0, false, err
+	}
+	if creator == nil {
+		return 0, false, nil
+	}
+	return *creator, true, nil
+}
+
+func (w *webui) createGroup(msg json.RawMessage) error {
+	var nm groupUpdate
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+	nm.Name = strings.TrimSpace(nm.Name)
+	if err := w.checkMembers(nm.Members); err != nil {
+		return err
+	}
+
+	groupId, err := newMessageId()
+	if err != nil {
+		return err
+	}
+
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	exec, err := tx.Exec("INSERT INTO `group` (`group_id`,`name`,`creator`) VALUES (?,?,0)", groupId, nm.Name)
+	if err != nil {
+		return err
+	}
+	id, err := exec.LastInsertId()
+	if err != nil {
+		return err
+	}
+	nm.Id = uint(id)
+	if err = setMembers(tx, nm.Id, nm.Members); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	w.newGroup(nm.Id, nm.Name, nm.Members)
+	go w.announceGroup(nm.Id, nil)
+	return nil
+}
+
+func (w *webui) updateGroup(msg json.RawMessage) error {
+	var nm groupUpdate
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+	nm.Name = strings.TrimSpace(nm.Name)
+	if err := w.checkMembers(nm.Members); err != nil {
+		return err
+	}
+	creator, known, err := w.db.groupCreator(nm.Id)
+	if err != nil {
+		return err
+	}
+	if known && creator > 0 {
+		return errors.New("only the creator can change the group")
+	}
+
+	// removed members should learn about it as well
+	_, removed, err := w.db.getGroup(nm.Id)
+	if err != nil {
+		return err
+	}
+
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE `group` SET `name`=? WHERE `rowid`=?", nm.Name, nm.Id)
+	if err != nil {
+		return err
+	}
+	if err = setMembers(tx, nm.Id, nm.Members); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	go w.broadcast("group", groupChanged{Id: nm.Id, Name: nm.Name, Members: nm.Members})
+	go w.announceGroup(nm.Id, removed)
+	return nil
+}
+
+type groupChanged struct {
+	Id      uint   `json:"id"`
+	Name    string `json:"name"`
+	Members []uint `json:"members"`
+}
+
+// memberOf returns the groups a user is member of.
+func (db *database) memberOf(user uint) ([]uint, error) {
+	query, err := db.Query("SELECT `group` FROM `group_member` WHERE `user`=?", user)
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+
+	var groups []uint
+	for query.Next() {
+		var g uint
+		if err = query.Scan(&g); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, query.Err()
+}
+
+// groupChanged notifies the clients about the current name and members of a group.
+func (w *webui) groupChanged(group uint) {
+	nm := groupChanged{Id: group}
+	var name *string
+	if err := w.db.QueryRow("SELECT `name` FROM `group` WHERE `rowid`=?", group).Scan(&name); err != nil {
+		log.Errorf("[webui, db] %s", err)
+		return
+	}
+	if name != nil {
+		nm.Name = *name
+	}
+
+	query, err := w.db.Query("SELECT `user` FROM `group_member` WHERE `group`=?", group)
+	if err != nil {
+		log.Errorf("[webui, db] %s", err)
+		return
+	}
+	defer query.Close()
+	for query.Next() {
+		var m uint
+		if err = query.Scan(&m); err != nil {
+			log.Errorf("[webui, db] %s", err)
+			return
+		}
+		nm.Members = append(nm.Members, m)
+	}
+
+	w.broadcast("group", nm)
+}
+
+// announceGroup sends the current membership of a group to its members and the extra addresses.
+func (w *webui) announceGroup(group uint, extra []*nymo.Address) {
+	info, addresses, err := w.db.getGroup(group)
+	if err != nil {
+		log.Errorf("[webui, db] %s", err)
+		return
+	}
+	payload, err := (&envelope{
+		Version: envelopeVersion,
+		Type:    envelopeGroup,
+		Group:   info,
+	}).marshal()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sent := make(map[string]bool)
+	for _, a := range append(addresses, extra...) {
+		key := string(a.Bytes())
+		if sent[key] {
+			continue
+		}
+		sent[key] = true
+		if err = w.sendPayload(a, payload, 0); err != nil {
+			log.Warnf("[webui] announcing group: %s", err)
+		}
+	}
+}
+
+func (w *webui) newGroup(id uint, name string, members []uint) {
+	ids := make([]string, len(members))
+	for i, m := range members {
+		ids[i] = strconv.FormatUint(uint64(m), 10)
+	}
+
+	var buf bytes.Buffer
+	err := indexTpl.ExecuteTemplate(&buf, "contact", contact{
+		RowID:   id,
+		Alias:   &name,
+		Group:   true,
+		Members: strings.Join(ids, ","),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.broadcast("new_group", buf.String())
+}
+
+// resolveGroup returns the local group of a received group message, creating it if needed.
+// It returns 0 if the sender is not allowed to post into the group. Only accepted contacts (or our other devices,
+// sender 0) can add us to a new group, so strangers cannot bypass the request inbox.
+func (db *database) resolveGroup(sender uint, senderKey []byte, info *groupInfo) (uint, error) {
+	row := db.QueryRow("SELECT `rowid` FROM `group` WHERE `group_id`=?", info.Id)
+	var group uint
+	err := row.Scan(&group)
+	if err == nil {
+		row = db.QueryRow("SELECT COUNT(*) FROM `group_member` WHERE `group`=? AND `user`=?", group, sender)
+		var cnt int
+		if err = row.Scan(&cnt); err != nil || cnt <= 0 {
+			return 0, err
+		}
+		return group, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+	if !info.hasMember(senderKey) || !info.hasMember(web.user.Address().Bytes()) {
+		return 0, nil
+	}
+	if sender > 0 {
+		state, err := db.getUserState(sender)
+		if err != nil || state != contactAccepted {
+			return 0, err
+		}
+	}
+
+	members, err := db.lookupMembers(info)
+	if err != nil {
+		return 0, err
+	}
+	// groups from older versions name no creator
+	var creator interface{}
+	if bytes.Equal(info.Creator, web.user.Address().Bytes()) {
+		creator = 0
+	} else if info.Creator != nil && info.hasMember(info.Creator) {
+		if creator, err = db.lookupUserId(info.Creator, contactRequest); err != nil {
+			return 0, err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	exec, err := tx.Exec("INSERT INTO `group` (`group_id`,`name`,`creator`) VALUES (?,?,?)", info.Id, info.Name, creator)
+	if err != nil {
+		return 0, err
+	}
+	id, err := exec.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	group = uint(id)
+	if err = setMembers(tx, group, members); err != nil {
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	web.newGroup(group, info.Name, members)
+	return group, nil
+}
+
+// lookupMembers returns the user IDs of the group members except ourselves.
+// If we are not a member anymore, the group is left without members.
+func (db *database) lookupMembers(info *groupInfo) ([]uint, error) {
+	self := web.user.Address().Bytes()
+	var members []uint
+	if !info.hasMember(self) {
+		return nil, nil
+	}
+	for _, m := range info.Members {
+		if bytes.Equal(m, self) {
+			continue
+		}
+		id, err := db.lookupUserId(m, contactRequest)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, id)
+	}
+	return members, nil
+}
+
+// storeGroupUpdate applies a membership change sent by the creator of the group.
+func (db *database) storeGroupUpdate(sender uint, senderKey []byte, info *groupInfo) error {
+	group, err := db.resolveGroup(sender, senderKey, info)
+	if err != nil || group <= 0 {
+		return err
+	}
+	creator, known, err := db.groupCreator(group)
+	if err != nil {
+		return err
+	}
+	if known && creator != sender {
+		log.WithField("group", group).Info("[webui] group update not from its creator ignored")
+		return nil
+	}
+
+	members, err := db.lookupMembers(info)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE `group` SET `name`=? WHERE `rowid`=?", info.Name, group)
+	if err != nil {
+		return err
+	}
+	if err = setMembers(tx, group, members); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	go web.broadcast("group", groupChanged{Id: group, Name: info.Name, Members: members})
+	return nil
+}
+
+func renderGroups(ctx context.Context, db *database, cr *indexRender) error {
+	q, err := db.QueryContext(ctx, "WITH `lmsg` AS (SELECT MAX(ROWID) AS `last_id` FROM `dec_msg` WHERE NOT `quarantine` AND `group` IS NOT NULL GROUP BY `group`),"+
+		"`lmsg_c` AS (SELECT `group`, `self`, "+previewContent+", `last_id` FROM `dec_msg` JOIN `lmsg` ON `dec_msg`.ROWID = `lmsg`.`last_id`)"+
+		"SELECT `g`.`rowid`, `name`, `expire`, IFNULL((SELECT GROUP_CONCAT(`user`) FROM `group_member` WHERE `group`=`g`.`rowid`), ''), `pinned`, `muted`, `archived`, `last_id`, `self`, `content` "+
+		"FROM `group` `g` LEFT JOIN `lmsg_c` ON `g`.`rowid`=`lmsg_c`.`group`")
+	if err != nil {
+		return err
+	}
+	defer q.Close()
+
+	for q.Next() {
+		c := contact{Group: true}
+		var self *bool
+		if err := q.Scan(&c.RowID, &c.Alias, &c.Expire, &c.Members, &c.Pinned, &c.Muted, &c.Archived, &c.LastId, &self, &c.Message); err != nil {
+			return err
+		}
+		c.Self = self != nil && *self
+		if c.Archived {
+			cr.Archived = append(cr.Archived, c)
+		} else {
+			cr.Contacts = append(cr.Contacts, c)
+		}
+	}
+	if err = q.Err(); err != nil {
+		return err
+	}
+
+	// contacts and groups are ordered together
+	sortContacts(cr.Contacts)
+	sortContacts(cr.Archived)
+	return nil
+}
+
+// groupSender returns the display name of the sender of a received group message, or empty for direct messages.
+func (db *database) groupSender(conv conversation) (string, error) {
+	if conv.Group <= 0 {
+		return "", nil
+	}
+	return db.senderName(conv.Target)
+}
+
+// senderName returns the alias of a user, or its address if it has none.
+func (db *database) senderName(id uint) (string, error) {
+	row := db.QueryRow("SELECT `key`, `alias` FROM `user` WHERE `rowid`=?", id)
+	var key []byte
+	var alias *string
+	if err := row.Scan(&key, &alias); err != nil {
+		return "", err
+	}
+	if alias != nil && *alias != "" {
+		return *alias, nil
+	}
+	return nymo.ConvertAddrToStr(key), nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sessionWindow is how long the session caps of a peer carry over its reconnections.
+const sessionWindow = time.Hour
+
+type limitConfig struct {
+	DigestRate        uint
+	DigestInterval    time.Duration
+	MaxSessionDigests uint
+	MaxSessionPeers   uint
+	MaxPenalty        uint
+	PenaltyExpiry     time.Duration
+	MaxStorage        int64
+	AutoReplyRate     uint
+	AutoReplyInterval time.Duration
+}
+
+func getLimitConfig() *limitConfig {
+	cfg := &limitConfig{
+		DigestRate:        1000,
+		DigestInterval:    time.Minute,
+		MaxSessionDigests: 100000,
+		MaxSessionPeers:   200,
+		MaxPenalty:        10,
+		PenaltyExpiry:     24 * time.Hour,
+		AutoReplyRate:     3,
+		AutoReplyInterval: time.Minute,
+	}
+	if config.Limit.DigestRate != nil {
+		cfg.DigestRate = *config.Limit.DigestRate
+	}
+	if config.Limit.DigestInterval != nil {
+		cfg.DigestInterval = time.Duration(*config.Limit.DigestInterval)
+	}
+	if config.Limit.MaxSessionDigests != nil {
+		cfg.MaxSessionDigests = *config.Limit.MaxSessionDigests
+	}
+	if config.Limit.MaxSessionPeers != nil {
+		cfg.MaxSessionPeers = *config.Limit.MaxSessionPeers
+	}
+	if config.Limit.MaxPenalty != nil {
+		cfg.MaxPenalty = *config.Limit.MaxPenalty
+	}
+	if config.Limit.PenaltyExpiry != nil {
+		cfg.PenaltyExpiry = time.Duration(*config.Limit.PenaltyExpiry)
+	}
+	if config.Limit.AutoReplyRate != nil {
+		cfg.AutoReplyRate = *config.Limit.AutoReplyRate
+	}
+	if config.Limit.AutoReplyInterval != nil {
+		cfg.AutoReplyInterval = time.Duration(*config.Limit.AutoReplyInterval)
+	}
+	cfg.MaxStorage = config.Limit.MaxStorage
+	return cfg
+}
+
+// tokenBucket allows at most rate tokens per interval, with a burst of rate tokens.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	per    time.Duration
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate uint, per time.Duration) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		per:    per,
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// take consumes up to n tokens and returns the number actually consumed. A bucket with a rate of 0 is unlimited.
+func (b *tokenBucket) take(n uint) uint {
+	if b.rate <= 0 {
+		return n
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	b.tokens += b.rate * float64(now.Sub(b.last)) / float64(b.per)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	if float64(n) > b.tokens {
+		n = uint(b.tokens)
+	}
+	b.tokens -= float64(n)
+	return n
+}
+
+// peerLimit is the gossip quota of a peer, shared by its connections so reconnecting does not reset it. The session
+// counts restart with the first connection sessionWindow after the session started. Session caps of 0 are unlimited.
+type peerLimit struct {
+	lock    sync.Mutex
+	bucket  *tokenBucket
+	start   time.Time
+	digests uint
+	peers   uint
+	// conns is the number of connections holding the quota, which is evicted once it has none and its session is over
+	conns   uint
+	evicted bool
+}
+
+// peerLimit returns the quota of the peer for a new connection, starting a new session if the last one is over.
+// Connections release it on disconnection.
+func (db *database) peerLimit(row uint) *peerLimit {
+	db.peerLimits.Range(func(k, v interface{}) bool {
+		l := v.(*peerLimit)
+		l.lock.Lock()
+		if l.conns <= 0 && time.Since(l.start) >= sessionWindow {
+			l.evicted = true
+			db.peerLimits.Delete(k)
+		}
+		l.lock.Unlock()
+		return true
+	})
+
+	for {
+		v, _ := db.peerLimits.LoadOrStore(row, &peerLimit{bucket: newTokenBucket(db.limit.DigestRate, db.limit.DigestInterval)})
+		l := v.(*peerLimit)
+
+		l.lock.Lock()
+		if l.evicted {
+			l.lock.Unlock()
+			continue
+		}
+		if time.Since(l.start) >= sessionWindow {
+			l.start = time.Now()
+			l.digests, l.peers = 0, 0
+		}
+		l.conns++
+		l.lock.Unlock()
+		return l
+	}
+}
+
+// release is called when a connection holding the quota is gone.
+func (l *peerLimit) release() {
+	l.lock.Lock()
+	l.conns--
+	l.lock.Unlock()
+}
+
+// takeDigests accepts up to n digests within the session cap and the token bucket. It returns the number accepted
+// and whether the session cap cut them, as opposed to the token bucket.
+func (l *peerLimit) takeDigests(n, max uint) (uint, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	capped := false
+	if remain := max - l.digests; max > 0 && n > remain {
+		n, capped = remain, true
+	}
+	n = l.bucket.take(n)
+	l.digests += n
+	return n, capped
+}
+
+// remainPeers returns the number of new peer URLs still accepted in the session.
+func (l *peerLimit) remainPeers(max uint) uint {
+	if max <= 0 {
+		return math.MaxUint
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return max - l.peers
+}
+
+func (l *peerLimit) addPeers(n uint) {
+	l.lock.Lock()
+	l.peers += n
+	l.lock.Unlock()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	b := newTokenBucket(10, time.Minute)
+	if n := b.take(4); n != 4 {
+		t.Fatalf("took %d of 4", n)
+	}
+	if n := b.take(10); n != 6 {
+		t.Fatalf("took %d over the burst, want 6", n)
+	}
+	if n := b.take(1); n != 0 {
+		t.Fatalf("took %d from an empty bucket", n)
+	}
+
+	// half the interval refills half the rate
+	b.last = b.last.Add(-30 * time.Second)
+	if n := b.take(10); n != 5 {
+		t.Fatalf("took %d after half the interval, want 5", n)
+	}
+
+	// refilling stops at the burst
+	b.last = b.last.Add(-time.Hour)
+	if n := b.take(100); n != 10 {
+		t.Fatalf("took %d after a long pause, want 10", n)
+	}
+
+	if n := newTokenBucket(0, time.Minute).take(1000); n != 1000 {
+		t.Fatalf("unlimited bucket took %d of 1000", n)
+	}
+}
+
+func TestPeerLimitDigests(t *testing.T) {
+	l := &peerLimit{bucket: newTokenBucket(100, time.Minute)}
+
+	if n, capped := l.takeDigests(30, 50); n != 30 || capped {
+		t.Fatalf("took %d (capped %v), want 30", n, capped)
+	}
+	// the session cap cuts before the bucket
+	if n, capped := l.takeDigests(30, 50); n != 20 || !capped {
+		t.Fatalf("took %d (capped %v), want 20 capped", n, capped)
+	}
+	if n, capped := l.takeDigests(1, 50); n != 0 || !capped {
+		t.Fatalf("took %d (capped %v) over the session cap", n, capped)
+	}
+
+	// throttling by the bucket is not capping
+	if n, capped := l.takeDigests(100, 0); n != 50 || capped {
+		t.Fatalf("took %d (capped %v) without session cap, want 50 throttled", n, capped)
+	}
+}
+
+func TestPeerLimitPeers(t *testing.T) {
+	l := &peerLimit{}
+	if n := l.remainPeers(0); n != math.MaxUint {
+		t.Fatalf("%d peers remain without session cap", n)
+	}
+	l.addPeers(3)
+	if n := l.remainPeers(5); n != 2 {
+		t.Fatalf("%d peers remain, want 2", n)
+	}
+}
+
+func TestPeerLimitSession(t *testing.T) {
+	db := &database{limit: &limitConfig{DigestRate: 100, DigestInterval: time.Minute}}
+
+	l := db.peerLimit(1)
+	l.takeDigests(10, 0)
+	if db.peerLimit(1) != l || l.digests != 10 {
+		t.Fatal("reconnecting reset the quota")
+	}
+	l.release()
+
+	// an expired session restarts while connected, and is evicted without connection
+	l.start = l.start.Add(-sessionWindow)
+	if db.peerLimit(1) != l || l.digests != 0 {
+		t.Fatalf("session not restarted: %d digests", l.digests)
+	}
+	l.release()
+	l.release()
+	l.start = l.start.Add(-sessionWindow)
+	db.peerLimit(2)
+	if _, ok := db.peerLimits.Load(uint(1)); ok || !l.evicted {
+		t.Fatal("unused quota not evicted")
+	}
+	if db.peerLimit(1) == l {
+		t.Fatal("evicted quota reused")
+	}
+}
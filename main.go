@@ -29,6 +29,8 @@ func addPeer(addr string) {
 }
 
 func main() {
+	loadConfig()
+
 	pair, err := tls.LoadX509KeyPair(config.Peer.TLSCert, config.Peer.TLSKey)
 	if err != nil {
 		log.Fatal(err)
@@ -44,6 +46,7 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	web.key, web.cert = key, pair
 	web.user = nymo.OpenUser(web.db, key, pair, getCoreConfig())
 	log.Infof("[core] opened user %s", web.user.Address())
 
@@ -80,6 +83,24 @@ func main() {
 		web.user.Run(ctx)
 	}()
 
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		web.runSweeper(ctx)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		web.runWebhooks(ctx)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		web.runScheduler(ctx)
+	}()
+
 	errLogger := log.WriterLevel(logrus.ErrorLevel)
 	defer errLogger.Close()
 	srv := http.Server{
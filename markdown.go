@@ -0,0 +1,92 @@
+package main
+
+import (
+	"html/template"
+	"regexp"
+	"strings"
+
+	"github.com/nymo-net/nymo"
+)
+
+const mimeMarkdown = "text/markdown"
+
+// inlineMarkup matches, in order of the submatches: inline code, [text](url) links, bare links, **bold** and *italics*.
+var inlineMarkup = regexp.MustCompile("`([^`]+)`" +
+	`|\[([^\]]+)\]\(((?:https?|nymo)://[^\s)]+)\)` +
+	`|((?:https?|nymo)://[^\s<>"']+)` +
+	`|\*\*(.+?)\*\*` +
+	`|\*([^*\s][^*]*)\*`)
+
+// renderMarkdown renders a lightweight subset of Markdown. All text is escaped and only a fixed set of tags is
+// produced, so the result is safe to embed. Links to nymo addresses open a conversation instead of navigating.
+func renderMarkdown(text string) template.HTML {
+	var b strings.Builder
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		if strings.HasPrefix(lines[i], "```") {
+			end := i + 1
+			for end < len(lines) && !strings.HasPrefix(lines[end], "```") {
+				end++
+			}
+			b.WriteString(`<pre class="mb-0"><code>`)
+			b.WriteString(template.HTMLEscapeString(strings.Join(lines[i+1:end], "\n")))
+			b.WriteString("</code></pre>")
+			i = end
+			continue
+		}
+		if i > 0 && !strings.HasPrefix(lines[i-1], "```") {
+			b.WriteString("<br>")
+		}
+		renderInline(&b, lines[i])
+	}
+	return template.HTML(b.String())
+}
+
+func renderInline(b *strings.Builder, s string) {
+	last := 0
+	for _, m := range inlineMarkup.FindAllStringSubmatchIndex(s, -1) {
+		b.WriteString(template.HTMLEscapeString(s[last:m[0]]))
+		last = m[1]
+
+		switch {
+		case m[2] >= 0:
+			b.WriteString("<code>")
+			b.WriteString(template.HTMLEscapeString(s[m[2]:m[3]]))
+			b.WriteString("</code>")
+		case m[4] >= 0:
+			writeLink(b, s[m[6]:m[7]], s[m[4]:m[5]])
+		case m[8] >= 0:
+			link := strings.TrimRight(s[m[8]:m[9]], ".,;:!?)")
+			writeLink(b, link, link)
+			b.WriteString(template.HTMLEscapeString(s[m[8]+len(link) : m[9]]))
+		case m[10] >= 0:
+			b.WriteString("<strong>")
+			renderInline(b, s[m[10]:m[11]])
+			b.WriteString("</strong>")
+		case m[12] >= 0:
+			b.WriteString("<em>")
+			renderInline(b, s[m[12]:m[13]])
+			b.WriteString("</em>")
+		}
+	}
+	b.WriteString(template.HTMLEscapeString(s[last:]))
+}
+
+func writeLink(b *strings.Builder, link, text string) {
+	text = template.HTMLEscapeString(text)
+	if strings.HasPrefix(link, "nymo://") {
+		addr := nymo.NewAddress(link)
+		if addr == nil {
+			b.WriteString(text)
+			return
+		}
+		b.WriteString(`<a class="text-reset" href="#" data-chat="`)
+		b.WriteString(template.HTMLEscapeString(addr.String()))
+	} else {
+		b.WriteString(`<a class="text-reset" target="_blank" rel="noopener noreferrer" href="`)
+		b.WriteString(template.HTMLEscapeString(link))
+	}
+	b.WriteString(`">`)
+	b.WriteString(text)
+	b.WriteString("</a>")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const linkTag = `<a class="text-reset" target="_blank" rel="noopener noreferrer" href=`
+
+func TestRenderMarkdown(t *testing.T) {
+	addr := testAddress(t).String()
+
+	tests := []struct {
+		name, text, want string
+	}{
+		{"plain", "hello", "hello"},
+		{"escaped tags", "<script>alert(1)</script>", "&lt;script&gt;alert(1)&lt;/script&gt;"},
+		{"escaped quotes", `a & b "q" 'x'`, "a &amp; b &#34;q&#34; &#39;x&#39;"},
+		{"javascript link", "[click](javascript:alert(1))", "[click](javascript:alert(1))"},
+		{"bare javascript", "javascript:alert(1)", "javascript:alert(1)"},
+		{"data link", "[x](data:text/html;base64,PHNjcmlwdD4=)", "[x](data:text/html;base64,PHNjcmlwdD4=)"},
+		{"bare data", "data:text/html,<script>", "data:text/html,&lt;script&gt;"},
+		{"link", "[site](https://e.com)", linkTag + `"https://e.com">site</a>`},
+		{"link text escaped", `[a" onclick="x](https://e.com)`, linkTag + `"https://e.com">a&#34; onclick=&#34;x</a>`},
+		{"bare link stops at quotes", `https://e.com/?a="><b>`, linkTag + `"https://e.com/?a=">https://e.com/?a=</a>&#34;&gt;&lt;b&gt;`},
+		{"bare link punctuation", "see https://e.com/path.", "see " + linkTag + `"https://e.com/path">https://e.com/path</a>.`},
+		{"bare link in parentheses", "(https://e.com)", "(" + linkTag + `"https://e.com">https://e.com</a>)`},
+		{"nymo link", "[me](" + addr + ")", `<a class="text-reset" href="#" data-chat="` + addr + `">me</a>`},
+		{"invalid nymo link", "[me](nymo://invalid)", "me"},
+		{"bare invalid nymo link", "nymo://invalid", "nymo://invalid"},
+		{"nested", "**bold *it* `code`**", "<strong>bold <em>it</em> <code>code</code></strong>"},
+		{"link in bold", "**[x](https://e.com)**", "<strong>" + linkTag + `"https://e.com">x</a></strong>`},
+		{"no markup in code", "`**not bold** <i>`", "<code>**not bold** &lt;i&gt;</code>"},
+		{"no markup in link text", "[**x**](https://e.com)", linkTag + `"https://e.com">**x**</a>`},
+		{"escaped in italics", "*<b>*", "<em>&lt;b&gt;</em>"},
+		{"lines", "one\r\ntwo\nthree", "one<br>two<br>three"},
+		{"code block", "```\n<b>x</b>\n*y*\n```\nafter", `<pre class="mb-0"><code>&lt;b&gt;x&lt;/b&gt;` + "\n*y*</code></pre>after"},
+		{"unclosed code block", "```\n<i>", `<pre class="mb-0"><code>&lt;i&gt;</code></pre>`},
+	}
+	for _, test := range tests {
+		if got := string(renderMarkdown(test.text)); got != test.want {
+			t.Errorf("%s: %q renders\n%s\nwant\n%s", test.name, test.text, got, test.want)
+		}
+	}
+}
+
+// TestRenderMarkdownTags checks that no input produces tags or attributes beyond the fixed set.
+func TestRenderMarkdownTags(t *testing.T) {
+	allowed := []string{"<strong>", "</strong>", "<em>", "</em>", "<code>", "</code>", "<br>", "</a>",
+		`<pre class="mb-0">`, "</pre>", linkTag, `<a class="text-reset" href="#" data-chat=`}
+	for _, text := range []string{
+		"**<img src=x onerror=alert(1)>**",
+		"*`<svg/onload=alert(1)>`*",
+		"[<b>](https://e.com/<b>)",
+		"```\n</code></pre><script>\n```",
+		"https://e.com/\"onmouseover=alert(1)",
+	} {
+		html := string(renderMarkdown(text))
+		for i := strings.IndexByte(html, '<'); i >= 0; i = strings.IndexByte(html, '<') {
+			ok := false
+			for _, tag := range allowed {
+				if strings.HasPrefix(html[i:], tag) {
+					html, ok = html[i+len(tag):], true
+					break
+				}
+			}
+			if !ok {
+				t.Errorf("%q renders an unexpected tag at %q", text, html[i:])
+				break
+			}
+		}
+	}
+}
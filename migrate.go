@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migrations upgrade the schema of an existing database, migrations[i] from version i (PRAGMA user_version) to
+// version i+1, one step for each feature that changed the schema. createDatabase starts at the latest version. They
+// run with foreign keys off, so a table can be rebuilt when ALTER TABLE cannot add a column.
+//
+// language=sql
+var migrations = []string{
+	// peer penalties
+	`ALTER TABLE "peer" ADD COLUMN "penalize" INTEGER DEFAULT 0 NOT NULL;`,
+
+	// contact states and quarantined messages
+	`ALTER TABLE "user" ADD COLUMN "state" INTEGER DEFAULT 0 NOT NULL;
+ALTER TABLE "dec_msg" ADD COLUMN "quarantine" BOOLEAN DEFAULT FALSE NOT NULL;`,
+
+	// attachments: "dec_msg" is rebuilt, as it is referenced by its rowid, which must be a column
+	`CREATE TABLE "dec_msg_new"
+(
+	"rowid" INTEGER PRIMARY KEY,
+	"target" INTEGER NOT NULL
+		REFERENCES "user" ON UPDATE CASCADE ON DELETE CASCADE,
+	"self" BOOLEAN NOT NULL,
+	"content" TEXT NOT NULL,
+	"send_time" INTEGER,
+	"quarantine" BOOLEAN DEFAULT FALSE NOT NULL
+);
+INSERT INTO "dec_msg_new" ("rowid", "target", "self", "content", "send_time", "quarantine")
+	SELECT ROWID, "target", "self", "content", "send_time", "quarantine" FROM "dec_msg";
+DROP TABLE "dec_msg";
+ALTER TABLE "dec_msg_new" RENAME TO "dec_msg";
+
+CREATE TABLE "attachment"
+(
+	"rowid" INTEGER PRIMARY KEY,
+	"target" INTEGER NOT NULL
+		REFERENCES "user" ON UPDATE CASCADE ON DELETE CASCADE,
+	"file_id" BLOB NOT NULL,
+	"msg" INTEGER
+		REFERENCES "dec_msg" ON UPDATE CASCADE ON DELETE CASCADE,
+	"name" TEXT NOT NULL,
+	"mime" TEXT NOT NULL,
+	"size" INTEGER NOT NULL,
+	"total" INTEGER NOT NULL,
+	"data" BLOB,
+	"created" INTEGER,
+	UNIQUE ("target", "file_id")
+);
+
+CREATE TABLE "attachment_chunk"
+(
+	"attachment" INTEGER NOT NULL
+		REFERENCES "attachment" ON UPDATE CASCADE ON DELETE CASCADE,
+	"idx" INTEGER NOT NULL,
+	"data" BLOB NOT NULL,
+	PRIMARY KEY ("attachment", "idx")
+) WITHOUT ROWID;`,
+
+	// message envelopes: "dec_msg" is rebuilt to make message IDs unique per contact
+	`CREATE TABLE "dec_msg_new"
+(
+	"rowid" INTEGER PRIMARY KEY,
+	"target" INTEGER NOT NULL
+		REFERENCES "user" ON UPDATE CASCADE ON DELETE CASCADE,
+	"self" BOOLEAN NOT NULL,
+	"content" TEXT NOT NULL,
+	"send_time" INTEGER,
+	"quarantine" BOOLEAN DEFAULT FALSE NOT NULL,
+	"msg_id" BLOB,
+	"reply_to" BLOB,
+	"content_type" TEXT DEFAULT 'text/plain' NOT NULL,
+	"version" INTEGER DEFAULT 0 NOT NULL,
+	UNIQUE ("target", "msg_id")
+);
+INSERT INTO "dec_msg_new" ("rowid", "target", "self", "content", "send_time", "quarantine")
+	SELECT "rowid", "target", "self", "content", "send_time", "quarantine" FROM "dec_msg";
+DROP TABLE "dec_msg";
+ALTER TABLE "dec_msg_new" RENAME TO "dec_msg";`,
+
+	// replies
+	`ALTER TABLE "dec_msg" ADD COLUMN "reply_row" INTEGER
+	REFERENCES "dec_msg" ON UPDATE CASCADE ON DELETE SET NULL;`,
+
+	// receipts
+	`ALTER TABLE "user" ADD COLUMN "receipts" BOOLEAN DEFAULT TRUE NOT NULL;
+ALTER TABLE "dec_msg" ADD COLUMN "receipt" INTEGER DEFAULT 0 NOT NULL;`,
+
+	// groups
+	`ALTER TABLE "dec_msg" ADD COLUMN "group" INTEGER
+	REFERENCES "group" ON UPDATE CASCADE ON DELETE CASCADE;
+
+CREATE TABLE "group"
+(
+	"rowid" INTEGER PRIMARY KEY,
+	"group_id" BLOB UNIQUE NOT NULL,
+	"name" TEXT
+);
+
+CREATE TABLE "group_member"
+(
+	"group" INTEGER NOT NULL
+		REFERENCES "group" ON UPDATE CASCADE ON DELETE CASCADE,
+	"user" INTEGER NOT NULL
+		REFERENCES "user" ON UPDATE CASCADE ON DELETE CASCADE,
+	PRIMARY KEY ("group", "user")
+) WITHOUT ROWID;`,
+
+	// disappearing messages
+	`ALTER TABLE "user" ADD COLUMN "expire" INTEGER DEFAULT 0 NOT NULL;
+ALTER TABLE "group" ADD COLUMN "expire" INTEGER DEFAULT 0 NOT NULL;
+ALTER TABLE "dec_msg" ADD COLUMN "expire" INTEGER DEFAULT 0 NOT NULL;
+ALTER TABLE "dec_msg" ADD COLUMN "expire_at" INTEGER;
+
+CREATE INDEX "dec_msg_expire_at" ON "dec_msg" ("expire_at");
+
+CREATE TABLE "authored"
+(
+	"dec_msg" INTEGER NOT NULL
+		REFERENCES "dec_msg" ON UPDATE CASCADE ON DELETE CASCADE,
+	"message" INTEGER NOT NULL
+		REFERENCES "message" ON UPDATE CASCADE ON DELETE CASCADE,
+	PRIMARY KEY ("dec_msg", "message")
+) WITHOUT ROWID;`,
+
+	// verified contacts
+	`ALTER TABLE "user" ADD COLUMN "verified" BOOLEAN DEFAULT FALSE NOT NULL;`,
+
+	// contact details: "user" is rebuilt, as "created" has no constant default
+	`CREATE TABLE "user_new"
+(
+	"rowid" INTEGER PRIMARY KEY,
+	"key" BLOB UNIQUE NOT NULL,
+	"alias" TEXT,
+	"state" INTEGER DEFAULT 0 NOT NULL,
+	"receipts" BOOLEAN DEFAULT TRUE NOT NULL,
+	"expire" INTEGER DEFAULT 0 NOT NULL,
+	"verified" BOOLEAN DEFAULT FALSE NOT NULL,
+	"note" TEXT,
+	"avatar" BLOB,
+	"avatar_mime" TEXT,
+	"created" INTEGER DEFAULT (CAST(STRFTIME('%s', 'now') AS INTEGER) * 1000) NOT NULL,
+	"last_seen" INTEGER
+);
+INSERT INTO "user_new" ("rowid", "key", "alias", "state", "receipts", "expire", "verified")
+	SELECT "rowid", "key", "alias", "state", "receipts", "expire", "verified" FROM "user";
+DROP TABLE "user";
+ALTER TABLE "user_new" RENAME TO "user";
+
+CREATE TABLE "user_tag"
+(
+	"user" INTEGER NOT NULL
+		REFERENCES "user" ON UPDATE CASCADE ON DELETE CASCADE,
+	"tag" TEXT NOT NULL,
+	PRIMARY KEY ("user", "tag")
+) WITHOUT ROWID;`,
+
+	// pinned, muted and archived conversations
+	`ALTER TABLE "user" ADD COLUMN "pinned" BOOLEAN DEFAULT FALSE NOT NULL;
+ALTER TABLE "user" ADD COLUMN "muted" BOOLEAN DEFAULT FALSE NOT NULL;
+ALTER TABLE "user" ADD COLUMN "archived" BOOLEAN DEFAULT FALSE NOT NULL;
+ALTER TABLE "group" ADD COLUMN "pinned" BOOLEAN DEFAULT FALSE NOT NULL;
+ALTER TABLE "group" ADD COLUMN "muted" BOOLEAN DEFAULT FALSE NOT NULL;
+ALTER TABLE "group" ADD COLUMN "archived" BOOLEAN DEFAULT FALSE NOT NULL;`,
+
+	// notification previews
+	`ALTER TABLE "user" ADD COLUMN "previews" BOOLEAN DEFAULT TRUE NOT NULL;`,
+
+	// webhooks
+	`CREATE TABLE "webhook_delivery"
+(
+	"rowid" INTEGER PRIMARY KEY,
+	"url" TEXT NOT NULL,
+	"event" TEXT NOT NULL,
+	"payload" BLOB NOT NULL,
+	"created" INTEGER NOT NULL,
+	"attempts" INTEGER DEFAULT 0 NOT NULL,
+	"next_attempt" INTEGER,
+	"status" INTEGER,
+	"error" TEXT,
+	"delivered" INTEGER
+);
+
+CREATE INDEX "webhook_delivery_next_attempt" ON "webhook_delivery" ("next_attempt");`,
+
+	// auto reply rules
+	`CREATE TABLE "auto_reply"
+(
+	"rowid" INTEGER PRIMARY KEY,
+	"sender" TEXT,
+	"content" TEXT,
+	"reply" TEXT NOT NULL,
+	"enabled" BOOLEAN DEFAULT TRUE NOT NULL
+);`,
+
+	// scheduled messages
+	`ALTER TABLE "dec_msg" ADD COLUMN "send_at" INTEGER;
+
+CREATE INDEX "dec_msg_send_at" ON "dec_msg" ("send_at");`,
+
+	// drafts
+	`ALTER TABLE "user" ADD COLUMN "draft" TEXT;
+ALTER TABLE "group" ADD COLUMN "draft" TEXT;`,
+
+	// edited and retracted messages
+	`ALTER TABLE "dec_msg" ADD COLUMN "edited" INTEGER;
+ALTER TABLE "dec_msg" ADD COLUMN "retracted" BOOLEAN DEFAULT FALSE NOT NULL;
+
+CREATE TABLE "msg_edit"
+(
+	"dec_msg" INTEGER NOT NULL
+		REFERENCES "dec_msg" ON UPDATE CASCADE ON DELETE CASCADE,
+	"content" TEXT NOT NULL,
+	"content_type" TEXT NOT NULL,
+	"time" INTEGER NOT NULL
+);
+
+CREATE INDEX "msg_edit_dec_msg" ON "msg_edit" ("dec_msg");`,
+
+	// reactions
+	`CREATE TABLE "reaction"
+(
+	"dec_msg" INTEGER NOT NULL
+		REFERENCES "dec_msg" ON UPDATE CASCADE ON DELETE CASCADE,
+	"user" INTEGER NOT NULL
+		REFERENCES "user" ON UPDATE CASCADE ON DELETE CASCADE,
+	"emoji" TEXT NOT NULL,
+	"time" INTEGER NOT NULL,
+	PRIMARY KEY ("dec_msg", "user")
+) WITHOUT ROWID;`,
+
+	// multi-device sync
+	`ALTER TABLE "user" ADD COLUMN "sync" BOOLEAN DEFAULT FALSE NOT NULL;`,
+
+	// receive times
+	`ALTER TABLE "dec_msg" ADD COLUMN "recv_time" INTEGER;`,
+
+	// gossip statistics
+	`ALTER TABLE "peer" ADD COLUMN "url_hash" BLOB;
+ALTER TABLE "peer" ADD COLUMN "last_seen" INTEGER;
+ALTER TABLE "peer" ADD COLUMN "offered" INTEGER DEFAULT 0 NOT NULL;
+ALTER TABLE "peer" ADD COLUMN "fetched" INTEGER DEFAULT 0 NOT NULL;
+ALTER TABLE "peer" ADD COLUMN "listed" INTEGER DEFAULT 0 NOT NULL;
+ALTER TABLE "peer" ADD COLUMN "gossiped" INTEGER DEFAULT 0 NOT NULL;`,
+
+	// propagation tracing
+	`ALTER TABLE "authored" ADD COLUMN "trace" BOOLEAN DEFAULT FALSE NOT NULL;`,
+
+	// the running total of stored bytes, see overQuota
+	`CREATE TABLE "storage"
+(
+	"size" INTEGER NOT NULL
+);
+
+INSERT INTO "storage" VALUES ((SELECT TOTAL(LENGTH("msg")) FROM "message") + (SELECT TOTAL(LENGTH("data")) FROM "attachment") +
+	(SELECT TOTAL(LENGTH("data")) FROM "attachment_chunk"));
+
+CREATE TRIGGER "message_storage_insert" AFTER INSERT ON "message"
+BEGIN
+	UPDATE "storage" SET "size"="size"+IFNULL(LENGTH(NEW."msg"), 0);
+END;
+
+CREATE TRIGGER "message_storage_update" AFTER UPDATE OF "msg" ON "message"
+BEGIN
+	UPDATE "storage" SET "size"="size"+IFNULL(LENGTH(NEW."msg"), 0)-IFNULL(LENGTH(OLD."msg"), 0);
+END;
+
+CREATE TRIGGER "message_storage_delete" AFTER DELETE ON "message"
+BEGIN
+	UPDATE "storage" SET "size"="size"-IFNULL(LENGTH(OLD."msg"), 0);
+END;
+
+CREATE TRIGGER "attachment_storage_insert" AFTER INSERT ON "attachment"
+BEGIN
+	UPDATE "storage" SET "size"="size"+IFNULL(LENGTH(NEW."data"), 0);
+END;
+
+CREATE TRIGGER "attachment_storage_update" AFTER UPDATE OF "data" ON "attachment"
+BEGIN
+	UPDATE "storage" SET "size"="size"+IFNULL(LENGTH(NEW."data"), 0)-IFNULL(LENGTH(OLD."data"), 0);
+END;
+
+CREATE TRIGGER "attachment_storage_delete" AFTER DELETE ON "attachment"
+BEGIN
+	UPDATE "storage" SET "size"="size"-IFNULL(LENGTH(OLD."data"), 0);
+END;
+
+CREATE TRIGGER "attachment_chunk_storage_insert" AFTER INSERT ON "attachment_chunk"
+BEGIN
+	UPDATE "storage" SET "size"="size"+IFNULL(LENGTH(NEW."data"), 0);
+END;
+
+CREATE TRIGGER "attachment_chunk_storage_update" AFTER UPDATE OF "data" ON "attachment_chunk"
+BEGIN
+	UPDATE "storage" SET "size"="size"+IFNULL(LENGTH(NEW."data"), 0)-IFNULL(LENGTH(OLD."data"), 0);
+END;
+
+CREATE TRIGGER "attachment_chunk_storage_delete" AFTER DELETE ON "attachment_chunk"
+BEGIN
+	UPDATE "storage" SET "size"="size"-IFNULL(LENGTH(OLD."data"), 0);
+END;`,
+
+	// peer bans
+	`ALTER TABLE "peer" ADD COLUMN "penalized" INTEGER;`,
+
+	// quarantined files, as only the first chunk carries the name
+	`ALTER TABLE "attachment" ADD COLUMN "quarantine" BOOLEAN DEFAULT FALSE NOT NULL;`,
+
+	// group creators, who alone can change the members
+	`ALTER TABLE "group" ADD COLUMN "creator" INTEGER
+	REFERENCES "user" ON UPDATE CASCADE ON DELETE SET NULL;`,
+
+	// scheduled messages being sent, which stay scheduled until sent
+	`ALTER TABLE "dec_msg" ADD COLUMN "sending" INTEGER;`,
+}
+
+// migrate upgrades the schema of the database to the latest version.
+func migrate(db *sql.DB) (err error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var version int
+	if err = conn.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version >= len(migrations) {
+		return nil
+	}
+
+	// foreign keys cannot be toggled inside a transaction
+	if _, err = conn.ExecContext(ctx, "PRAGMA foreign_keys=OFF"); err != nil {
+		return err
+	}
+	defer func() {
+		if _, e := conn.ExecContext(ctx, "PRAGMA foreign_keys=ON"); err == nil {
+			err = e
+		}
+	}()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for ; version < len(migrations); version++ {
+		log.Infof("[webui] migrating database to version %d", version+1)
+		if _, err = tx.Exec(migrations[version]); err != nil {
+			return fmt.Errorf("migrating to version %d: %w", version+1, err)
+		}
+	}
+
+	query, err := tx.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return err
+	}
+	violated := query.Next()
+	_ = query.Close()
+	if violated {
+		return fmt.Errorf("migrating to version %d: foreign key violation", version)
+	}
+
+	if _, err = tx.Exec(fmt.Sprintf("PRAGMA user_version=%d", version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
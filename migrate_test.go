@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// baselineSchema is the schema of the original release, before any migration.
+//
+// language=sql
+const baselineSchema = `CREATE TABLE "user"
+(
+	"rowid" INTEGER PRIMARY KEY,
+	"key" BLOB UNIQUE NOT NULL,
+	"alias" TEXT
+);
+
+CREATE TABLE "peer"
+(
+	"rowid" INTEGER PRIMARY KEY,
+	"id" BLOB UNIQUE NOT NULL
+);
+
+CREATE TABLE "dec_msg"
+(
+	"target" INTEGER NOT NULL
+		REFERENCES "user" ON UPDATE CASCADE ON DELETE CASCADE,
+	"self" BOOLEAN NOT NULL,
+	"content" TEXT NOT NULL,
+	"send_time" INTEGER
+);
+
+CREATE TABLE "message"
+(
+	"rowid" INTEGER PRIMARY KEY,
+	"hash" BLOB NOT NULL,
+	"cohort" INTEGER NOT NULL,
+	"msg" BLOB,
+	"pow" INTEGER,
+	"deleted" BOOLEAN DEFAULT FALSE NOT NULL,
+	UNIQUE ("hash", "cohort")
+);
+
+CREATE TABLE "peer_link"
+(
+	"url_hash" BLOB PRIMARY KEY,
+	"url" TEXT NOT NULL,
+	"cohort" INTEGER NOT NULL,
+	"penalize" INTEGER DEFAULT 0 NOT NULL
+) WITHOUT ROWID;
+
+CREATE TABLE "known_msg"
+(
+	"peer_id" INTEGER NOT NULL
+		REFERENCES "peer" ON UPDATE CASCADE ON DELETE CASCADE,
+	"msg" INTEGER NOT NULL
+		REFERENCES "message" ON UPDATE CASCADE ON DELETE CASCADE,
+	PRIMARY KEY ("peer_id", "msg")
+) WITHOUT ROWID;
+
+CREATE TABLE "known_peer"
+(
+	"peer_id" INTEGER NOT NULL
+		REFERENCES "peer" ON UPDATE CASCADE ON DELETE CASCADE,
+	"url_hash" BLOB NOT NULL,
+	PRIMARY KEY ("peer_id", "url_hash")
+) WITHOUT ROWID;`
+
+func openTestDB(t *testing.T, name string) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), name)+dbOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func queryStrings(t *testing.T, db *sql.DB, query string, args ...interface{}) (ret []string) {
+	t.Helper()
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s string
+		if err = rows.Scan(&s); err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, s)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// describeSchema lists the columns, foreign keys, indexes and triggers of the tables, ignoring the column order
+// (ALTER TABLE appends columns) and the names SQLite gives to automatic indexes.
+func describeSchema(t *testing.T, db *sql.DB) []string {
+	t.Helper()
+	var ret []string
+	for _, table := range queryStrings(t, db, "SELECT `name` FROM `sqlite_master` WHERE `type`='table' AND `name` NOT LIKE 'sqlite_%'") {
+		ret = append(ret, "table "+table)
+		ret = append(ret, queryStrings(t, db, "SELECT ? || ' column ' || `name` || ' ' || `type` || ' ' || `notnull` || ' ' || "+
+			"IFNULL(`dflt_value`, 'NULL') || ' ' || `pk` FROM pragma_table_info(?)", table, table)...)
+		ret = append(ret, queryStrings(t, db, "SELECT ? || ' fk ' || `from` || ' ' || `table` || ' ' || IFNULL(`to`, '') || ' ' || "+
+			"`on_update` || ' ' || `on_delete` FROM pragma_foreign_key_list(?)", table, table)...)
+		for _, index := range queryStrings(t, db, "SELECT `name` FROM pragma_index_list(?)", table) {
+			cols := queryStrings(t, db, "SELECT IFNULL(`name`, '') FROM pragma_index_info(?) ORDER BY `seqno`", index)
+			var unique int
+			if err := db.QueryRow("SELECT `unique` FROM pragma_index_list(?) WHERE `name`=?", table, index).Scan(&unique); err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(index, "sqlite_autoindex_") {
+				index = "auto"
+			}
+			ret = append(ret, fmt.Sprintf("%s index %s %d %s", table, index, unique, strings.Join(cols, ",")))
+		}
+	}
+	ret = append(ret, queryStrings(t, db, "SELECT 'trigger ' || `name` || ' on ' || `tbl_name` FROM `sqlite_master` WHERE `type`='trigger'")...)
+	sort.Strings(ret)
+	return ret
+}
+
+func TestMigrateBaseline(t *testing.T) {
+	fresh := openTestDB(t, "fresh.db")
+	if _, err := fresh.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	db := openTestDB(t, "old.db")
+	if _, err := db.Exec(baselineSchema); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Exec("INSERT INTO `user` (`rowid`, `key`) VALUES (0, x'00'), (1, x'01');" +
+		"INSERT INTO `dec_msg` VALUES (1, 1, 'sent', 1000), (1, 0, 'received', 2000);" +
+		"INSERT INTO `peer` (`id`) VALUES (x'aa');" +
+		"INSERT INTO `message` (`hash`, `cohort`, `msg`) VALUES (x'01', 1, x'0102030405')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var version int
+	if err = db.QueryRow("PRAGMA user_version").Scan(&version); err != nil || version != len(migrations) {
+		t.Fatalf("version %d, want %d (err %v)", version, len(migrations), err)
+	}
+	if v := queryStrings(t, db, "SELECT `table` FROM pragma_foreign_key_check"); len(v) > 0 {
+		t.Errorf("foreign key violations in %v", v)
+	}
+
+	want, got := describeSchema(t, fresh), describeSchema(t, db)
+	wantSet := make(map[string]bool)
+	for _, s := range want {
+		wantSet[s] = true
+	}
+	for _, s := range got {
+		if !wantSet[s] {
+			t.Errorf("unexpected after migration: %s", s)
+		}
+		delete(wantSet, s)
+	}
+	for _, s := range want {
+		if wantSet[s] {
+			t.Errorf("missing after migration: %s", s)
+		}
+	}
+
+	rows := queryStrings(t, db, "SELECT `rowid` || ' ' || `target` || ' ' || `self` || ' ' || `content` FROM `dec_msg` ORDER BY `rowid`")
+	if strings.Join(rows, "; ") != "1 1 1 sent; 2 1 0 received" {
+		t.Errorf("messages after migration: %v", rows)
+	}
+	var size int64
+	if err = db.QueryRow("SELECT `size` FROM `storage`").Scan(&size); err != nil || size != 5 {
+		t.Errorf("storage size %d, want 5 (err %v)", size, err)
+	}
+
+	// migrating again does nothing
+	if err = migrate(db); err != nil {
+		t.Fatal(err)
+	}
+}
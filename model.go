@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,29 +16,70 @@ type baseClient = [2]interface{}
 type baseServer = [2]json.RawMessage
 
 type newMessage struct {
-	Target  interface{} `json:"target"`
-	Message string      `json:"message,omitempty"`
-	Content string      `json:"content"`
+	Target     interface{} `json:"target"`
+	Group      uint        `json:"group,omitempty"`
+	Message    string      `json:"message,omitempty"`
+	Content    string      `json:"content"`
+	Quarantine bool        `json:"quarantine,omitempty"`
+	ReplyTo    int64       `json:"reply_to,omitempty"`
+	SendAt     int64       `json:"send_at,omitempty"`
+	Markdown   bool        `json:"markdown,omitempty"`
+
+	card *contactCard
+	// composed is set for messages from the composer, whose draft is then cleared
+	composed bool
 }
 
 type msgRender struct {
-	Self      bool
-	Content   string
-	SendTime  *time.Time
-	PrepareId int64
+	Id         int64
+	Self       bool
+	Content    string
+	Markdown   bool
+	Card       *contactCard
+	SendTime   *time.Time
+	SendAt     *time.Time
+	Quarantine bool
+	Receipt    int
+	Edited     *time.Time
+	Retracted  bool
+	Reactions  []reactionCount
+	SeenBy     int
+	Attachment *attachmentInfo
+	Quote      *quoteInfo
+	Sender     string
+}
+
+// quoteInfo is the message a message replies to.
+type quoteInfo struct {
+	Id      int64
+	Self    bool
+	Content string
 }
 
-func (w *webui) recvMessage(target uint, content string, sendTime time.Time) {
+func (w *webui) recvMessage(conv conversation, r msgRender) {
 	var buf bytes.Buffer
-	err := indexTpl.ExecuteTemplate(&buf, "message", msgRender{Content: content, SendTime: &sendTime})
+	err := indexTpl.ExecuteTemplate(&buf, "message", r)
 	if err != nil {
 		log.Fatal(err)
 	}
-	w.broadcast("new_msg", newMessage{
-		Target:  target,
-		Content: buf.String(),
-		Message: content,
-	})
+	nm := newMessage{
+		Target:     conv.Target,
+		Group:      conv.Group,
+		Content:    buf.String(),
+		Quarantine: r.Quarantine,
+	}
+	if r.Card != nil {
+		nm.Message = "Contact card"
+	} else if !r.Quarantine {
+		nm.Message = r.Content
+	}
+	w.broadcast("new_msg", nm)
+
+	if !r.Quarantine {
+		if err = w.notify(conv, r); err != nil {
+			log.Errorf("[webui, db] notify: %s", err)
+		}
+	}
 }
 
 type setAlias struct {
@@ -45,15 +87,29 @@ type setAlias struct {
 	Name *string `json:"name,omitempty"`
 }
 
+type setState struct {
+	Id    uint `json:"id"`
+	State int  `json:"state"`
+}
+
 type metadata struct {
-	Version string   `json:"version"`
-	Address string   `json:"address"`
-	Peers   []string `json:"peers"`
-	Servers []string `json:"servers"`
+	Version  string   `json:"version"`
+	Address  string   `json:"address"`
+	Peers    []string `json:"peers"`
+	Servers  []string `json:"servers"`
+	Previews bool     `json:"previews"`
+	Sync     bool     `json:"sync"`
+}
+
+type msgChanged struct {
+	conversation
+	Id      int64  `json:"id"`
+	Content string `json:"content"`
 }
 
 type msgSent struct {
 	Target  uint    `json:"target"`
+	Group   uint    `json:"group,omitempty"`
 	Id      int64   `json:"id"`
 	Message string  `json:"message,omitempty"`
 	Content string  `json:"content,omitempty"`
@@ -69,14 +125,15 @@ func (w *webui) broadcast(action string, msg interface{}) {
 	}
 }
 
-func (w *webui) msgSent(target uint, id int64, msg, content string, err error) {
+func (w *webui) msgSent(conv conversation, id int64, msg, content string, err error) {
 	var errStr *string
 	if err != nil {
 		errStr = new(string)
 		*errStr = err.Error()
 	}
 	w.broadcast("msg_sent", msgSent{
-		Target:  target,
+		Target:  conv.Target,
+		Group:   conv.Group,
 		Id:      id,
 		Message: msg,
 		Content: content,
@@ -84,11 +141,14 @@ func (w *webui) msgSent(target uint, id int64, msg, content string, err error) {
 	})
 }
 
-func (w *webui) newUser(row uint, id []byte) {
+func (w *webui) newUser(row uint, id []byte, state int) {
 	var buf bytes.Buffer
 	err := indexTpl.ExecuteTemplate(&buf, "contact", contact{
-		RowID:   row,
-		Address: id,
+		RowID:    row,
+		Address:  id,
+		State:    state,
+		Receipts: true,
+		Created:  time.Now().UnixMilli(),
 	})
 	if err != nil {
 		log.Fatal(err)
@@ -101,98 +161,307 @@ func (w *webui) newMessage(msg json.RawMessage) error {
 	if err := json.Unmarshal(msg, &nm); err != nil {
 		return err
 	}
+	nm.composed = true
+	return w.sendText(&nm, false)
+}
 
+// sendText sends a text message, auto marks it as automatic reply which is never answered automatically.
+func (w *webui) sendText(nm *newMessage, auto bool) error {
 	nm.Message = strings.TrimSpace(nm.Message)
 	if nm.Message == "" {
 		return errors.New("empty message")
 	}
+	sendAt, err := scheduleTime(nm.SendAt)
+	if err != nil {
+		return err
+	}
 
-	var address *nymo.Address
-	switch addr := nm.Target.(type) {
-	case float64:
-		target := uint(addr)
-		if target <= 0 {
-			return errors.New("invalid receiver id")
+	var conv conversation
+	var addresses []*nymo.Address
+	var group *groupInfo
+	if nm.Group > 0 {
+		conv.Group = nm.Group
+		group, addresses, err = w.lookupGroup(nm.Group)
+		if err != nil {
+			return err
 		}
-
-		row := w.db.QueryRow("SELECT `key` FROM `user` WHERE `rowid`=?", target)
-		if row.Err() != nil {
-			return row.Err()
+	} else {
+		target, address, err := w.lookupTarget(nm.Target)
+		if err != nil {
+			return err
 		}
-		var receiver []byte
-		if err := row.Scan(&receiver); err != nil {
+		conv.Target = target
+		addresses = []*nymo.Address{address}
+	}
+
+	over, err := w.db.overQuota()
+	if err != nil {
+		return err
+	}
+	if over {
+		return errors.New("storage quota exceeded")
+	}
+
+	env, err := newEnvelope(envelopeText)
+	if err != nil {
+		return err
+	}
+	env.ContentType = mimeText
+	if nm.Markdown {
+		env.ContentType = mimeMarkdown
+	}
+	env.Text = nm.Message
+	if nm.card != nil {
+		env.Type, env.ContentType, env.Text, env.Contact = envelopeContact, mimeContact, "", nm.card
+	}
+	env.Group = group
+	env.Auto = auto
+	env.Expire, err = w.db.getExpiry(conv)
+	if err != nil {
+		return err
+	}
+
+	var quote *quoteInfo
+	var replyRow *int64
+	if nm.ReplyTo > 0 {
+		quote, env.ReplyTo, err = w.db.getQuote(conv, nm.ReplyTo)
+		if err != nil {
 			return err
 		}
+		if env.ReplyTo == nil {
+			return errors.New("message cannot be replied to")
+		}
+		replyRow = &quote.Id
+	}
 
-		address = nymo.NewAddressFromBytes(receiver)
-		if address == nil {
-			log.Fatal("[webui, db] invalid receiver address")
+	payload, err := env.marshal()
+	if err != nil {
+		return err
+	}
+
+	var sendAtArg interface{}
+	if sendAt != nil {
+		sendAtArg = sendAt.UnixMilli()
+	}
+	exec, err := w.db.Exec("INSERT INTO `dec_msg` (`target`,`group`,`self`,`content`,`msg_id`,`reply_to`,`reply_row`,`content_type`,`version`,`expire`,`send_at`) "+
+		"VALUES (?,?,TRUE,?,?,?,?,?,?,?,?)",
+		conv.Target, nullId(conv.Group), nm.Message, env.Id, env.ReplyTo, replyRow, env.ContentType, env.Version, env.Expire, sendAtArg)
+	if err != nil {
+		return err
+	}
+
+	insertId, err := exec.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	if nm.composed {
+		if err = w.updateDraft(conv, ""); err != nil {
+			return err
 		}
-		nm.Target = target
+	}
+
+	r := msgRender{Id: insertId, Self: true, Content: nm.Message, Markdown: nm.Markdown, Card: nm.card, Quote: quote, SendAt: sendAt}
+	if sendAt != nil {
+		// the payload is built again when the message is due, so it can still be edited
+		go w.broadcastOwn(conv, r)
+		return nil
+	}
+	go w.sendMessage(conv, addresses, r, [][]byte{payload})
+	return nil
+}
+
+// lookupTarget resolves a receiver given either as user id or as address string.
+func (w *webui) lookupTarget(t interface{}) (uint, *nymo.Address, error) {
+	switch addr := t.(type) {
+	case float64:
+		return w.lookupTargetId(uint(addr))
 	case string:
-		address = nymo.NewAddress(addr)
+		address := nymo.NewAddress(addr)
 		if address == nil {
-			return errors.New("invalid receiver address")
+			return 0, nil, errors.New("invalid receiver address")
 		}
-		var err error
-		nm.Target, err = w.db.lookupUserId(address.Bytes())
+		target, err := w.db.lookupUserId(address.Bytes(), contactAccepted)
 		if err != nil {
-			return err
+			return 0, nil, err
 		}
+		return target, address, w.acceptContact(target)
 	default:
-		return fmt.Errorf("unknown receiver type %T", addr)
+		return 0, nil, fmt.Errorf("unknown receiver type %T", addr)
 	}
+}
 
-	exec, err := w.db.Exec("INSERT INTO `dec_msg` (`target`,`self`,`content`) VALUES (?,TRUE,?)", nm.Target, nm.Message)
+func (w *webui) lookupTargetId(target uint) (uint, *nymo.Address, error) {
+	address, err := w.db.lookupAddress(target)
 	if err != nil {
-		return err
+		return 0, nil, err
 	}
+	return target, address, w.acceptContact(target)
+}
 
-	insertId, err := exec.LastInsertId()
+// lookupAddress returns the address of a contact, without accepting it as lookupTargetId does.
+func (db *database) lookupAddress(target uint) (*nymo.Address, error) {
+	if target <= 0 {
+		return nil, errors.New("invalid receiver id")
+	}
+
+	row := db.QueryRow("SELECT `key` FROM `user` WHERE `rowid`=?", target)
+	if row.Err() != nil {
+		return nil, row.Err()
+	}
+	var receiver []byte
+	if err := row.Scan(&receiver); err != nil {
+		return nil, err
+	}
+
+	address := nymo.NewAddressFromBytes(receiver)
+	if address == nil {
+		log.Fatal("[webui, db] invalid receiver address")
+	}
+	return address, nil
+}
+
+// broadcastOwn shows a message we have not sent yet to the clients.
+func (w *webui) broadcastOwn(conv conversation, r msgRender) {
+	var buf bytes.Buffer
+	e := indexTpl.ExecuteTemplate(&buf, "message", r)
+	if e != nil {
+		log.Fatalf("[webui, template] %s", e)
+	}
+	w.broadcast("new_msg", newMessage{
+		Target:  conv.Target,
+		Group:   conv.Group,
+		Content: buf.String(),
+	})
+}
+
+// msgChanged shows the current rendering of a message to the clients.
+func (w *webui) msgChanged(action string, conv conversation, id int64) {
+	msgs, err := w.db.renderMessages("`d`.ROWID=?", id)
 	if err != nil {
-		return err
+		log.Errorf("[webui, db] %s", err)
+		return
+	}
+	if len(msgs) <= 0 {
+		// deleted meanwhile
+		return
 	}
 
-	go func() {
-		var buf bytes.Buffer
-		e := indexTpl.ExecuteTemplate(&buf, "message", msgRender{
-			Self:      true,
-			Content:   nm.Message,
-			PrepareId: insertId,
-		})
-		if e != nil {
-			log.Fatalf("[webui, template] %s", e)
-		}
-		oriMsg := nm.Message
-		nm.Message = ""
-		nm.Content = buf.String()
-		buf.Reset()
-		w.broadcast("new_msg", nm)
-
-		sendTime := time.Now()
-		e = w.user.NewMessage(address, []byte(oriMsg))
-		if e == nil {
-			_, e = w.db.Exec("UPDATE `dec_msg` SET `send_time`=? WHERE ROWID=?", sendTime.UnixMilli(), insertId)
-			if e != nil {
-				log.Fatalf("[webui, db] %s", e)
-			}
-			e = indexTpl.ExecuteTemplate(&buf, "message", msgRender{
-				Self:     true,
-				Content:  oriMsg,
-				SendTime: &sendTime,
-			})
-			if e != nil {
-				log.Fatalf("[webui, template] %s", e)
-			}
-		} else {
-			_, e = w.db.Exec("DELETE FROM `dec_msg` WHERE ROWID=?", insertId)
-			if e != nil {
-				log.Fatalf("[webui, db] %s", e)
+	var buf bytes.Buffer
+	if err = indexTpl.ExecuteTemplate(&buf, "message", msgs[0]); err != nil {
+		log.Fatalf("[webui, template] %s", err)
+	}
+	w.broadcast(action, msgChanged{conversation: conv, Id: id, Content: buf.String()})
+}
+
+// sendMessage sends the payloads of a prepared dec_msg row (r.Id) to every address, and notifies the clients of the result.
+func (w *webui) sendMessage(conv conversation, addresses []*nymo.Address, r msgRender, payloads [][]byte) {
+	w.broadcastOwn(conv, r)
+	w.deliverMessage(conv, addresses, r, payloads)
+}
+
+// deliverMessage sends the payloads of a dec_msg row already shown to the clients.
+func (w *webui) deliverMessage(conv conversation, addresses []*nymo.Address, r msgRender, payloads [][]byte) {
+	var buf bytes.Buffer
+	var e error
+	sendTime := time.Now()
+	// the message is kept if any member of a group got it, and the others are reported
+	failed := 0
+	for _, address := range addresses {
+		for _, p := range payloads {
+			if err := w.sendAuthored(address, p, r.Id, true); err != nil {
+				failed++
+				e = err
+				break
 			}
 		}
-		w.msgSent(nm.Target.(uint), insertId, oriMsg, buf.String(), e)
-	}()
+	}
+	if failed < len(addresses) {
+		_, err := w.db.Exec("UPDATE `dec_msg` SET `send_time`=@time, `send_at`=NULL, `sending`=NULL, "+
+			"`expire_at`=CASE WHEN `expire`>0 THEN @time+`expire`*1000 END WHERE ROWID=@id",
+			sql.Named("time", sendTime.UnixMilli()), sql.Named("id", r.Id))
+		if err != nil {
+			log.Fatalf("[webui, db] %s", err)
+		}
+		r.SendTime = &sendTime
+		err = indexTpl.ExecuteTemplate(&buf, "message", r)
+		if err != nil {
+			log.Fatalf("[webui, template] %s", err)
+		}
+		if err := w.webhookSent(conv, r, sendTime); err != nil {
+			log.Errorf("[webui, db] queueing webhooks: %s", err)
+		}
+		if err := w.syncSent(conv, r.Id); err != nil {
+			log.Warnf("[webui] syncing sent message: %s", err)
+		}
+		if failed > 0 {
+			e = fmt.Errorf("not sent to %d of %d members: %w", failed, len(addresses), e)
+		}
+	} else {
+		_, err := w.db.Exec("DELETE FROM `dec_msg` WHERE ROWID=?", r.Id)
+		if err != nil {
+			log.Fatalf("[webui, db] %s", err)
+		}
+	}
+	preview := r.Content
+	if r.Card != nil {
+		preview = "Contact card"
+	}
+	w.msgSent(conv, r.Id, preview, buf.String(), e)
+}
+
+// sendPayload sends a payload, recording the stored message as authored by the dec_msg row (if any) so it can be dropped
+// along with the row.
+func (w *webui) sendPayload(address *nymo.Address, payload []byte, row int64) error {
+	return w.sendAuthored(address, payload, row, false)
+}
+
+// sendAuthored is sendPayload, tracing the propagation of the stored message if trace is set (see trace.go).
+//
+// The core stores the message right after its proof-of-work inside NewMessage, so the send goes through a user of its
+// own whose database attributes the stored message to the row.
+func (w *webui) sendAuthored(address *nymo.Address, payload []byte, row int64, trace bool) error {
+	store := &authoredStore{database: w.db, row: row, trace: trace}
+	return nymo.OpenUser(store, w.key, w.cert, getCoreConfig()).NewMessage(address, payload)
+}
+
+// acceptContact moves a contact out of the request inbox when we talk to it.
+func (w *webui) acceptContact(id uint) error {
+	state, err := w.db.getUserState(id)
+	if err != nil {
+		return err
+	}
+	switch state {
+	case contactBlocked:
+		return errors.New("contact is blocked")
+	case contactRequest:
+		_, err = w.db.Exec("UPDATE `user` SET `state`=? WHERE `rowid`=?", contactAccepted, id)
+		if err != nil {
+			return err
+		}
+		go w.broadcast("state", setState{Id: id, State: contactAccepted})
+	}
+	return nil
+}
+
+func (w *webui) setState(msg json.RawMessage) error {
+	var nm setState
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+
+	switch nm.State {
+	case contactAccepted, contactRequest, contactBlocked:
+	default:
+		return errors.New("invalid contact state")
+	}
 
+	_, err := w.db.Exec("UPDATE `user` SET `state`=? WHERE `rowid`=? AND `rowid`>0", nm.State, nm.Id)
+	if err != nil {
+		return err
+	}
+
+	go w.broadcast("state", nm)
 	return nil
 }
 
@@ -212,18 +481,50 @@ func (w *webui) setAlias(msg json.RawMessage) error {
 }
 
 type history struct {
-	Id      uint   `json:"id"`
+	Id      uint   `json:"id,omitempty"`
+	Group   uint   `json:"group,omitempty"`
 	Content string `json:"content"`
+	Draft   string `json:"draft,omitempty"`
 }
 
 func (w *webui) getHistory(msg json.RawMessage) (*history, error) {
-	var id uint
-	if err := json.Unmarshal(msg, &id); err != nil {
+	conv, err := parseConversation(msg)
+	if err != nil {
 		return nil, err
 	}
 
-	query, err := w.db.Query(
-		"SELECT ROWID, `self`, `content`, `send_time` FROM `dec_msg` WHERE `target`=? ORDER BY ROWID DESC", id)
+	cond, arg := conv.where("`d`.")
+	msgs, err := w.db.renderMessages(cond, arg)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	err = indexTpl.ExecuteTemplate(&buf, "messages", msgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	draft, err := w.db.getDraft(conv)
+	if err != nil {
+		return nil, err
+	}
+	return &history{
+		Id:      conv.Target,
+		Group:   conv.Group,
+		Content: buf.String(),
+		Draft:   draft,
+	}, nil
+}
+
+// renderMessages returns the dec_msg rows (aliased `d`) matching the condition as rendered in the history, latest first.
+func (db *database) renderMessages(cond string, args ...interface{}) ([]msgRender, error) {
+	query, err := db.Query(
+		"SELECT `d`.ROWID, `d`.`self`, `d`.`content`, `d`.`send_time`, `d`.`send_at`, `d`.`content_type`, `d`.`quarantine`, `d`.`receipt`, `d`.`edited`, `d`.`retracted`, `a`.`rowid`, `mime`, `size`, "+
+			seenBy+", `q`.ROWID, `q`.`self`, `q`.`content`, `u`.`key`, `u`.`alias` "+
+			"FROM `dec_msg` `d` LEFT JOIN `attachment` `a` ON `a`.`msg`=`d`.ROWID "+
+			"LEFT JOIN `dec_msg` `q` ON `q`.ROWID=`d`.`reply_row` "+
+			"LEFT JOIN `user` `u` ON `u`.`rowid`=`d`.`target` AND `d`.`group` IS NOT NULL AND NOT `d`.`self` "+
+			"WHERE "+cond+" ORDER BY `d`.ROWID DESC", args...)
 	if err != nil {
 		return nil, err
 	}
@@ -231,25 +532,56 @@ func (w *webui) getHistory(msg json.RawMessage) (*history, error) {
 	var msgs []msgRender
 	for query.Next() {
 		var r msgRender
-		var t *int64
-		err = query.Scan(&r.PrepareId, &r.Self, &r.Content, &t)
+		var t, sendAt, edited, attId, size, quoteId *int64
+		var contentType string
+		var mime, quoteContent, alias *string
+		var quoteSelf *bool
+		var sender []byte
+		err = query.Scan(&r.Id, &r.Self, &r.Content, &t, &sendAt, &contentType, &r.Quarantine, &r.Receipt, &edited, &r.Retracted, &attId, &mime, &size,
+			&r.SeenBy, &quoteId, &quoteSelf, &quoteContent, &sender, &alias)
 		if err != nil {
+			_ = query.Close()
 			return nil, err
 		}
+		r.Markdown = attId == nil && contentType == mimeMarkdown
+		if attId == nil {
+			r.Card = cardOf(contentType, r.Content)
+		}
+		if alias != nil && *alias != "" {
+			r.Sender = *alias
+		} else if sender != nil {
+			r.Sender = nymo.ConvertAddrToStr(sender)
+		}
+		if quoteId != nil {
+			r.Quote = &quoteInfo{Id: *quoteId, Self: *quoteSelf, Content: *quoteContent}
+		}
 		if t != nil {
 			r.SendTime = new(time.Time)
 			*r.SendTime = time.UnixMilli(*t)
 		}
+		if sendAt != nil {
+			r.SendAt = new(time.Time)
+			*r.SendAt = time.UnixMilli(*sendAt)
+		}
+		if edited != nil {
+			r.Edited = new(time.Time)
+			*r.Edited = time.UnixMilli(*edited)
+		}
+		if attId != nil {
+			r.Attachment = &attachmentInfo{Id: *attId, Name: r.Content, Mime: *mime, Size: *size}
+		}
 		msgs = append(msgs, r)
 	}
+	if err = query.Err(); err != nil || len(msgs) <= 0 {
+		return msgs, err
+	}
 
-	var buf bytes.Buffer
-	err = indexTpl.ExecuteTemplate(&buf, "messages", msgs)
+	reactions, err := db.reactions(cond, args...)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	return &history{
-		Id:      id,
-		Content: buf.String(),
-	}, nil
+	for i := range msgs {
+		msgs[i].Reactions = reactions[msgs[i].Id]
+	}
+	return msgs, nil
 }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+// peerStats is what is known about the gossip with a peer. Offered counts the message digests it offered, Fetched
+// the ones among them we did not have and requested, and Listed the digests we offered it. Known is the number of
+// messages it is known to have, Overlap the ones of them in our store, and Gossiped the peer URLs it offered (Urls
+// of them being distinct).
+type peerStats struct {
+	Id        string  `json:"id"`
+	Url       *string `json:"url,omitempty"`
+	Connected bool    `json:"connected"`
+	LastSeen  *int64  `json:"last_seen,omitempty"`
+	Penalize  int     `json:"penalize"`
+	Offered   int     `json:"offered"`
+	Fetched   int     `json:"fetched"`
+	Listed    int     `json:"listed"`
+	Known     int     `json:"known"`
+	Overlap   int     `json:"overlap"`
+	Gossiped  int     `json:"gossiped"`
+	Urls      int     `json:"urls"`
+}
+
+// cohortStats counts the messages (the stored ones, and the digests only known) and the peer URLs of a cohort.
+type cohortStats struct {
+	Cohort   uint32 `json:"cohort"`
+	Stored   int    `json:"stored"`
+	Known    int    `json:"known"`
+	PeerUrls int    `json:"peer_urls"`
+}
+
+type networkStats struct {
+	Stored   int           `json:"stored"`
+	Known    int           `json:"known"`
+	PeerUrls int           `json:"peer_urls"`
+	Peers    []peerStats   `json:"peers"`
+	Cohorts  []cohortStats `json:"cohorts"`
+}
+
+func (w *webui) getNetworkStats() (*networkStats, error) {
+	ret := &networkStats{Peers: make([]peerStats, 0), Cohorts: make([]cohortStats, 0)}
+
+	err := w.db.QueryRow("SELECT IFNULL(SUM(`msg` IS NOT NULL), 0), COUNT(*), (SELECT COUNT(*) FROM `peer_link`) "+
+		"FROM `message` WHERE NOT `deleted`").Scan(&ret.Stored, &ret.Known, &ret.PeerUrls)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := w.db.Query("SELECT `p`.`rowid`, `p`.`id`, `l`.`url`, `p`.`last_seen`, `p`.`penalize`, `p`.`offered`, `p`.`fetched`, `p`.`listed`, " +
+		"(SELECT COUNT(*) FROM `known_msg` WHERE `peer_id`=`p`.`rowid`), " +
+		"(SELECT COUNT(*) FROM `known_msg` `k` JOIN `message` `m` ON `m`.`rowid`=`k`.`msg` WHERE `k`.`peer_id`=`p`.`rowid` AND `m`.`msg` IS NOT NULL), " +
+		"`p`.`gossiped`, (SELECT COUNT(*) FROM `known_peer` WHERE `peer_id`=`p`.`rowid`) " +
+		"FROM `peer` `p` LEFT JOIN `peer_link` `l` ON `l`.`url_hash`=`p`.`url_hash` ORDER BY `p`.`last_seen` DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+
+	for query.Next() {
+		var p peerStats
+		var row uint
+		var id []byte
+		err = query.Scan(&row, &id, &p.Url, &p.LastSeen, &p.Penalize, &p.Offered, &p.Fetched, &p.Listed,
+			&p.Known, &p.Overlap, &p.Gossiped, &p.Urls)
+		if err != nil {
+			return nil, err
+		}
+		p.Id = hex.EncodeToString(id)
+		_, p.Connected = w.peer.Load(row)
+		ret.Peers = append(ret.Peers, p)
+	}
+	if err = query.Err(); err != nil {
+		return nil, err
+	}
+
+	query, err = w.db.Query("SELECT `cohort`, SUM(`stored`), SUM(`known`), SUM(`urls`) FROM (" +
+		"SELECT `cohort`, `msg` IS NOT NULL AS `stored`, 1 AS `known`, 0 AS `urls` FROM `message` WHERE NOT `deleted` " +
+		"UNION ALL SELECT `cohort`, 0, 0, 1 FROM `peer_link`) GROUP BY `cohort` ORDER BY `cohort`")
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+
+	for query.Next() {
+		var c cohortStats
+		if err = query.Scan(&c.Cohort, &c.Stored, &c.Known, &c.PeerUrls); err != nil {
+			return nil, err
+		}
+		ret.Cohorts = append(ret.Cohorts, c)
+	}
+	return ret, query.Err()
+}
+
+// serveNetwork returns the gossip statistics of the peers and cohorts.
+func (w *webui) serveNetwork(wr http.ResponseWriter, _ *http.Request) {
+	stats, err := w.getNetworkStats()
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(wr).Encode(stats)
+}
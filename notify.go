@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"unicode/utf8"
+)
+
+const maxPreviewLength = 140
+
+// notification is sent along with each new message that should alert the user.
+type notification struct {
+	conversation
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+type setPreviews struct {
+	Previews bool `json:"previews"`
+}
+
+// preview shortens a message to be shown in a notification.
+func preview(content string) string {
+	if utf8.RuneCountInString(content) <= maxPreviewLength {
+		return content
+	}
+	return string([]rune(content)[:maxPreviewLength-1]) + "…"
+}
+
+func (db *database) getPreviews() (previews bool, err error) {
+	err = db.QueryRow("SELECT `previews` FROM `user` WHERE `rowid`=0").Scan(&previews)
+	return
+}
+
+// notify alerts the clients of a received message, unless the conversation is muted or it is a direct message from a
+// sender not accepted yet (waiting in the request inbox). Groups are only joined through accepted contacts, so their
+// members need not be accepted. The message content is only included if previews are enabled for our identity.
+func (w *webui) notify(conv conversation, r msgRender) error {
+	n := notification{conversation: conv}
+	var muted bool
+	if conv.Group > 0 {
+		n.Target = 0
+		if err := w.db.QueryRow("SELECT IFNULL(`name`, 'Group'), `muted` FROM `group` WHERE `rowid`=?", conv.Group).Scan(&n.Title, &muted); err != nil {
+			return err
+		}
+	} else {
+		var state int
+		if err := w.db.QueryRow("SELECT `muted`, `state` FROM `user` WHERE `rowid`=?", conv.Target).Scan(&muted, &state); err != nil {
+			return err
+		}
+		muted = muted || state == contactRequest
+	}
+	if muted {
+		return nil
+	}
+	if conv.Group <= 0 {
+		title, err := w.db.senderName(conv.Target)
+		if err != nil {
+			return err
+		}
+		n.Title = title
+	}
+
+	previews, err := w.db.getPreviews()
+	if err != nil {
+		return err
+	}
+	switch {
+	case !previews:
+		n.Body = "New message"
+	case r.Attachment != nil:
+		n.Body = "File: " + preview(r.Content)
+	case r.Card != nil:
+		n.Body = "Contact card"
+		if r.Card.Name != "" {
+			n.Body += ": " + preview(r.Card.Name)
+		}
+	default:
+		n.Body = preview(r.Content)
+	}
+	if r.Sender != "" && previews {
+		n.Body = r.Sender + ": " + n.Body
+	}
+
+	w.broadcast("notify", n)
+	return nil
+}
+
+func (w *webui) setPreviews(msg json.RawMessage) error {
+	var nm setPreviews
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+
+	_, err := w.db.Exec("UPDATE `user` SET `previews`=? WHERE `rowid`=0", nm.Previews)
+	if err != nil {
+		return err
+	}
+
+	go w.broadcast("previews", nm)
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+)
+
+// envelopeMagic leads payloads carrying an envelope. Payloads without it are legacy plain UTF-8 text.
+const envelopeMagic = 0
+
+// envelopeVersion is the current envelope version. Legacy plain text payloads are version 0.
+const envelopeVersion = 1
+
+const msgIdSize = 16
+
+const (
+	envelopeText     = "text"
+	envelopeFile     = "file"
+	envelopeReceipt  = "receipt"
+	envelopeGroup    = "group_update"
+	envelopeEdit     = "edit"
+	envelopeRetract  = "retract"
+	envelopeReaction = "reaction"
+	envelopeSync     = "sync"
+	envelopeContact  = "contact"
+)
+
+const mimeText = "text/plain"
+
+type envelope struct {
+	Version     uint         `json:"v"`
+	Id          []byte       `json:"id,omitempty"`
+	Type        string       `json:"type"`
+	ContentType string       `json:"content_type,omitempty"`
+	ReplyTo     []byte       `json:"reply_to,omitempty"`
+	Text        string       `json:"text,omitempty"`
+	File        *fileChunk   `json:"file,omitempty"`
+	Receipt     int          `json:"receipt,omitempty"`
+	Refs        [][]byte     `json:"refs,omitempty"`
+	Group       *groupInfo   `json:"group,omitempty"`
+	Expire      uint         `json:"expire,omitempty"`
+	Auto        bool         `json:"auto,omitempty"`
+	Reaction    string       `json:"reaction,omitempty"`
+	Sync        *syncInfo    `json:"sync,omitempty"`
+	Contact     *contactCard `json:"contact,omitempty"`
+}
+
+func newMessageId() ([]byte, error) {
+	id := make([]byte, msgIdSize)
+	_, err := rand.Read(id)
+	return id, err
+}
+
+// newEnvelope returns an envelope of the current version with a new message ID.
+func newEnvelope(typ string) (*envelope, error) {
+	id, err := newMessageId()
+	if err != nil {
+		return nil, err
+	}
+	return &envelope{Version: envelopeVersion, Id: id, Type: typ}, nil
+}
+
+func (e *envelope) marshal() ([]byte, error) {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{envelopeMagic}, buf...), nil
+}
+
+// parsePayload returns the envelope of a payload, wrapping legacy plain text into a version 0 envelope.
+func parsePayload(payload []byte) (*envelope, error) {
+	if len(payload) <= 0 || payload[0] != envelopeMagic {
+		return &envelope{Type: envelopeText, ContentType: mimeText, Text: string(payload)}, nil
+	}
+	env := new(envelope)
+	if err := json.Unmarshal(payload[1:], env); err != nil {
+		return nil, err
+	}
+	if env.Version <= 0 {
+		return nil, errors.New("invalid envelope version")
+	}
+	if env.Id != nil && len(env.Id) != msgIdSize {
+		return nil, errors.New("invalid message id")
+	}
+	if env.ReplyTo != nil && len(env.ReplyTo) != msgIdSize {
+		return nil, errors.New("invalid reply reference")
+	}
+	if env.Group != nil {
+		if err := env.Group.validate(); err != nil {
+			return nil, err
+		}
+	}
+	if env.ContentType == "" {
+		env.ContentType = mimeText
+	}
+	// contact cards only come in contact envelopes, where they are validated
+	if env.ContentType == mimeContact && env.Type != envelopeContact {
+		env.ContentType = mimeText
+	}
+	return env, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParsePayload(t *testing.T) {
+	id := bytes.Repeat([]byte{1}, msgIdSize)
+	tests := []struct {
+		name    string
+		payload string
+		want    *envelope
+	}{
+		{"legacy text", "hello", &envelope{Type: envelopeText, ContentType: mimeText, Text: "hello"}},
+		{"legacy json text", `{"v":1,"type":"retract"}`, &envelope{Type: envelopeText, ContentType: mimeText, Text: `{"v":1,"type":"retract"}`}},
+		{"legacy empty", "", &envelope{Type: envelopeText, ContentType: mimeText}},
+		{"current", "\x00" + `{"v":1,"type":"text","text":"hi"}`, &envelope{Version: 1, Type: envelopeText, ContentType: mimeText, Text: "hi"}},
+		{"content type kept", "\x00" + `{"v":1,"type":"text","content_type":"text/markdown"}`, &envelope{Version: 1, Type: envelopeText, ContentType: mimeMarkdown}},
+		{"contact type outside card", "\x00" + `{"v":1,"type":"text","content_type":"` + mimeContact + `"}`, &envelope{Version: 1, Type: envelopeText, ContentType: mimeText}},
+		{"unknown version", "\x00" + `{"v":7,"type":"text","text":"hi","future":true}`, &envelope{Version: 7, Type: envelopeText, ContentType: mimeText, Text: "hi"}},
+		{"unknown type", "\x00" + `{"v":1,"type":"poll"}`, &envelope{Version: 1, Type: "poll", ContentType: mimeText}},
+		{"reply", "\x00" + `{"v":1,"type":"text","id":"AQEBAQEBAQEBAQEBAQEBAQ==","reply_to":"AQEBAQEBAQEBAQEBAQEBAQ=="}`,
+			&envelope{Version: 1, Type: envelopeText, ContentType: mimeText, Id: id, ReplyTo: id}},
+	}
+	for _, test := range tests {
+		env, err := parsePayload([]byte(test.payload))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if env.Version != test.want.Version || env.Type != test.want.Type || env.ContentType != test.want.ContentType ||
+			env.Text != test.want.Text || !bytes.Equal(env.Id, test.want.Id) || !bytes.Equal(env.ReplyTo, test.want.ReplyTo) {
+			t.Errorf("%s: parsed %+v, want %+v", test.name, env, test.want)
+		}
+	}
+}
+
+func TestParsePayloadInvalid(t *testing.T) {
+	for _, payload := range []string{
+		"\x00",
+		"\x00not json",
+		"\x00" + `{"type":"text"}`,
+		"\x00" + `{"v":0,"type":"text"}`,
+		"\x00" + `{"v":-1,"type":"text"}`,
+		"\x00" + `{"v":1,"type":"text","id":"AQID"}`,
+		"\x00" + `{"v":1,"type":"text","reply_to":"AQID"}`,
+	} {
+		if env, err := parsePayload([]byte(payload)); err == nil {
+			t.Errorf("parsed invalid payload %q as %+v", payload, env)
+		}
+	}
+}
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	env, err := newEnvelope(envelopeText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.ReplyTo, err = newMessageId(); err != nil {
+		t.Fatal(err)
+	}
+	env.Text = "reply"
+	payload, err := env.marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := parsePayload(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != envelopeVersion || !bytes.Equal(got.Id, env.Id) || !bytes.Equal(got.ReplyTo, env.ReplyTo) || got.Text != env.Text {
+		t.Errorf("parsed %+v, want %+v", got, env)
+	}
+}
+
+func TestResolveQuote(t *testing.T) {
+	db := testDatabase(t)
+	_, err := db.Exec("INSERT INTO `user` (`rowid`, `key`) VALUES (0, x'00'), (1, x'01'), (2, x'02');" +
+		"INSERT INTO `dec_msg` (`target`, `self`, `content`, `msg_id`) VALUES " +
+		"(1, FALSE, 'theirs', x'01'), (1, TRUE, 'ours', x'02'), (2, FALSE, 'elsewhere', x'03')")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conv := conversation{Target: 1}
+	tests := []struct {
+		msgId []byte
+		want  *quoteInfo
+	}{
+		{[]byte{1}, &quoteInfo{Id: 1, Content: "theirs"}},
+		{[]byte{2}, &quoteInfo{Id: 2, Self: true, Content: "ours"}},
+		{[]byte{3}, nil},
+		{[]byte{4}, nil},
+	}
+	for _, test := range tests {
+		q, err := db.resolveQuote(conv, test.msgId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (q == nil) != (test.want == nil) || q != nil && *q != *test.want {
+			t.Errorf("quote of %x: %+v, want %+v", test.msgId, q, test.want)
+		}
+	}
+}
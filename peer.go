@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/nymo-net/nymo"
 	"github.com/nymo-net/nymo/pb"
@@ -16,6 +19,15 @@ func getPeerRowId(db *sql.DB, id []byte) (uint, error) {
 	return row, err
 }
 
+// peerSeen records the connection to a peer, and the URL it was dialed at (if any).
+func peerSeen(db *sql.DB, row uint, urlHash []byte) {
+	_, err := db.Exec("UPDATE `peer` SET `last_seen`=?, `url_hash`=IFNULL(?, `url_hash`) WHERE `rowid`=?",
+		time.Now().UnixMilli(), urlHash, row)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
 func digestToTable(tx *sql.Tx, digests []*pb.Digest) {
 	_, err := tx.Exec("CREATE TEMP TABLE `digest` (`hash` BLOB, `cohort` INTEGER, PRIMARY KEY (`hash`,`cohort`)) WITHOUT ROWID")
 	if err != nil {
@@ -76,13 +88,95 @@ type peerHandle struct {
 	db   *sql.DB
 	row  uint
 	last []uint
+
+	id      string
+	urlHash []byte
+	limit   *limitConfig
+	quota   *peerLimit
+	// banned is set (atomically, as the uplink and downlink share the handle) for peers with too many penalties,
+	// whose gossip is ignored as the core cannot refuse them
+	banned int32
+}
+
+func newPeerHandle(db *database, row uint, id string, urlHash []byte) *peerHandle {
+	p := &peerHandle{
+		db:      db.DB,
+		row:     row,
+		id:      id,
+		urlHash: urlHash,
+		limit:   db.limit,
+		quota:   db.peerLimit(row),
+	}
+	if db.peerBanned(row) {
+		p.ban()
+	}
+	return p
+}
+
+func (p *peerHandle) ban() {
+	atomic.StoreInt32(&p.banned, 1)
+	log.WithField("id", p.id).Warn("[core] peer has too many penalties, ignoring its gossip")
+}
+
+func (p *peerHandle) isBanned() bool {
+	return atomic.LoadInt32(&p.banned) > 0
+}
+
+// peerBanned clears the penalties of the peer if the last one expired, and reports whether it has too many.
+func (db *database) peerBanned(row uint) bool {
+	if db.limit.MaxPenalty <= 0 {
+		return false
+	}
+	_, err := db.Exec("UPDATE `peer` SET `penalize`=0 WHERE `rowid`=? AND `penalized`<?",
+		row, time.Now().Add(-db.limit.PenaltyExpiry).UnixMilli())
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return penalties(db.DB, row) >= db.limit.MaxPenalty
+}
+
+func penalties(db *sql.DB, row uint) (penalize uint) {
+	if err := db.QueryRow("SELECT `penalize` FROM `peer` WHERE `rowid`=?", row).Scan(&penalize); err != nil {
+		log.Panic(err)
+	}
+	return
+}
+
+func (p *peerHandle) penalize(reason string) {
+	log.WithField("id", p.id).Warnf("[core] peer penalized: %s", reason)
+	_, err := p.db.Exec("UPDATE `peer` SET `penalize`=`penalize`+1, `penalized`=? WHERE `rowid`=?", time.Now().UnixMilli(), p.row)
+	if err != nil {
+		log.Panic(err)
+	}
+	if p.urlHash != nil {
+		_, err = p.db.Exec("UPDATE `peer_link` SET `penalize`=`penalize`+1 WHERE `url_hash`=?", p.urlHash)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	if p.limit.MaxPenalty > 0 && !p.isBanned() && penalties(p.db, p.row) >= p.limit.MaxPenalty {
+		p.ban()
+	}
 }
 
 func (p *peerHandle) AddKnownMessages(digests []*pb.Digest) []*pb.Digest {
-	if len(digests) <= 0 {
+	if p.isBanned() || len(digests) <= 0 {
 		return nil
 	}
 
+	// throttled digests are only dropped, exceeding the session cap is a violation
+	allowed, capped := p.quota.takeDigests(uint(len(digests)), p.limit.MaxSessionDigests)
+	if capped {
+		p.penalize(fmt.Sprintf("digest flood (%d offered, %d accepted)", len(digests), allowed))
+	}
+	if allowed < uint(len(digests)) {
+		digests = digests[:allowed]
+		if len(digests) <= 0 {
+			return nil
+		}
+	}
+
 	tx, err := p.db.Begin()
 	defer tx.Rollback()
 
@@ -114,7 +208,13 @@ func (p *peerHandle) AddKnownMessages(digests []*pb.Digest) []*pb.Digest {
 	}
 	need := extractDigest(query)
 
-	// 6. drop temp tables
+	// 6. count what was offered and what we fetch
+	_, err = tx.Exec("UPDATE `peer` SET `offered`=`offered`+?, `fetched`=`fetched`+? WHERE `rowid`=?", len(digests), len(need), p.row)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// 7. drop temp tables
 	_, err = tx.Exec("DROP TABLE `digest`; DROP TABLE `interm`")
 	if err != nil {
 		log.Panic(err)
@@ -128,6 +228,9 @@ func (p *peerHandle) AddKnownMessages(digests []*pb.Digest) []*pb.Digest {
 }
 
 func (p *peerHandle) ListMessages(size uint) []*pb.Digest {
+	if p.isBanned() {
+		return nil
+	}
 	query, err := p.db.Query("SELECT `rowid`, `hash`, `cohort` FROM `message` WHERE (`msg` IS NOT NULL) AND `rowid` NOT IN (SELECT `msg` FROM `known_msg` WHERE `peer_id`=?) LIMIT ?", p.row, size)
 	if err != nil {
 		log.Panic(err)
@@ -156,14 +259,26 @@ func (p *peerHandle) AckMessages() {
 	if err != nil {
 		log.Panic(err)
 	}
+	_, err = p.db.Exec("UPDATE `peer` SET `listed`=`listed`+? WHERE `rowid`=?", len(p.last), p.row)
+	if err != nil {
+		log.Panic(err)
+	}
 	p.last = nil
 }
 
 func (p *peerHandle) AddKnownPeers(digests []*pb.Digest) []*pb.Digest {
-	if len(digests) <= 0 {
+	if p.isBanned() || len(digests) <= 0 {
 		return nil
 	}
 
+	if remain := p.quota.remainPeers(p.limit.MaxSessionPeers); uint(len(digests)) > remain {
+		p.penalize(fmt.Sprintf("peer flood (%d offered, %d accepted)", len(digests), remain))
+		digests = digests[:remain]
+		if len(digests) <= 0 {
+			return nil
+		}
+	}
+
 	tx, err := p.db.Begin()
 	defer tx.Rollback()
 
@@ -182,8 +297,15 @@ func (p *peerHandle) AddKnownPeers(digests []*pb.Digest) []*pb.Digest {
 		log.Panic(err)
 	}
 	ret := extractDigest(query)
+	p.quota.addPeers(uint(len(ret)))
 
-	// 4. drop temp table
+	// 4. count what was gossiped
+	_, err = tx.Exec("UPDATE `peer` SET `gossiped`=`gossiped`+? WHERE `rowid`=?", len(digests), p.row)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// 5. drop temp table
 	_, err = tx.Exec("DROP TABLE `digest`")
 	if err != nil {
 		log.Panic(err)
@@ -197,6 +319,9 @@ func (p *peerHandle) AddKnownPeers(digests []*pb.Digest) []*pb.Digest {
 }
 
 func (p *peerHandle) ListPeers(size uint) []*pb.Digest {
+	if p.isBanned() {
+		return nil
+	}
 	query, err := p.db.Query("SELECT `url_hash`, `cohort` FROM `peer_link` WHERE `url_hash` NOT IN (SELECT `url_hash` FROM `known_peer` WHERE `peer_id`=?) ORDER BY `penalize` LIMIT ?", p.row, size)
 	if err != nil {
 		log.Panic(err)
@@ -206,6 +331,7 @@ func (p *peerHandle) ListPeers(size uint) []*pb.Digest {
 
 func (p *peerHandle) Disconnect(err error) {
 	// TODO penalize
+	p.quota.release()
 	web.peer.Delete(p.row)
 	log.WithError(err).Debug("[core] peer disconnected")
 }
@@ -214,7 +340,7 @@ type peerEnum struct {
 	hash   []byte
 	url    string
 	cohort uint32
-	db     *sql.DB
+	db     *database
 	rows   *sql.Rows
 }
 
@@ -248,17 +374,15 @@ func (p *peerEnum) Connect(id [8]byte, cohort uint32) nymo.PeerHandle {
 	if err != nil {
 		log.Panic(err)
 	}
-	rowId, err := getPeerRowId(p.db, id[:])
+	rowId, err := getPeerRowId(p.db.DB, id[:])
 	if err != nil {
 		log.Panic(err)
 	}
 	encoded := hex.EncodeToString(id[:])
 	log.WithField("id", encoded).Debug("[core] peer connected")
+	peerSeen(p.db.DB, rowId, p.hash)
 	web.peer.Store(rowId, encoded)
-	return &peerHandle{
-		db:  p.db,
-		row: rowId,
-	}
+	return newPeerHandle(p.db, rowId, encoded, p.hash)
 }
 
 func (p *peerEnum) Close() {
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// setFlag pins, mutes or archives a conversation, depending on the op it is sent with.
+type setFlag struct {
+	conversation
+	Value bool `json:"value"`
+}
+
+// flagColumns maps the ops to the columns they set, on both the user and the group table.
+var flagColumns = map[string]string{
+	"pin":     "pinned",
+	"mute":    "muted",
+	"archive": "archived",
+}
+
+// table returns the table holding the settings of a conversation and its row in there.
+func (c conversation) table() (string, uint) {
+	if c.Group > 0 {
+		return "`group`", c.Group
+	}
+	return "`user`", c.Target
+}
+
+func (db *database) updateFlag(conv conversation, column string, value bool) (bool, error) {
+	table, id := conv.table()
+	exec, err := db.Exec("UPDATE "+table+" SET `"+column+"`=? WHERE `rowid`=? AND `rowid`>0 AND `"+column+"`!=?", value, id, value)
+	if err != nil {
+		return false, err
+	}
+	affected, err := exec.RowsAffected()
+	return affected > 0, err
+}
+
+func (w *webui) setFlag(op string, msg json.RawMessage) error {
+	var nm setFlag
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+
+	changed, err := w.db.updateFlag(nm.conversation, flagColumns[op], nm.Value)
+	if err != nil || !changed {
+		return err
+	}
+
+	go w.broadcast(op, nm)
+	return nil
+}
+
+// unarchive brings an archived conversation back once a new message arrives. Muted conversations stay archived.
+func (db *database) unarchive(conv conversation) error {
+	table, id := conv.table()
+	if conv.Group > 0 {
+		conv.Target = 0
+	}
+	exec, err := db.Exec("UPDATE "+table+" SET `archived`=FALSE WHERE `rowid`=? AND `archived` AND NOT `muted`", id)
+	if err != nil {
+		return err
+	}
+	if affected, err := exec.RowsAffected(); err != nil || affected <= 0 {
+		return err
+	}
+
+	go web.broadcast("archive", setFlag{conversation: conv})
+	return nil
+}
+
+// sortContacts orders pinned conversations first and muted ones last, each by their latest message.
+func sortContacts(contacts []contact) {
+	sort.SliceStable(contacts, func(i, j int) bool {
+		a, b := contacts[i], contacts[j]
+		if a.Pinned != b.Pinned {
+			return a.Pinned
+		}
+		if a.Muted != b.Muted {
+			return b.Muted
+		}
+		return a.LastId != nil && (b.LastId == nil || *a.LastId > *b.LastId)
+	})
+}
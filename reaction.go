@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nymo-net/nymo"
+)
+
+const maxReactionRunes = 8
+
+type setReaction struct {
+	conversation
+	Id       int64  `json:"id"`
+	Reaction string `json:"reaction"`
+}
+
+// reactionCount aggregates the reactions of a message with the same emoji.
+type reactionCount struct {
+	Emoji string
+	Count int
+	Mine  bool
+	Names []string
+}
+
+// validateReaction checks a reaction, the empty one removing the reaction.
+func validateReaction(r string) error {
+	if r == "" {
+		return nil
+	}
+	if !utf8.ValidString(r) || utf8.RuneCountInString(r) > maxReactionRunes || strings.TrimSpace(r) != r {
+		return errors.New("invalid reaction")
+	}
+	return nil
+}
+
+// storeReaction records the reaction of a user (0 being ourselves) to a message, unless a later one is known.
+func (db *database) storeReaction(id int64, user uint, reaction string, at time.Time) (bool, error) {
+	var exec sql.Result
+	var err error
+	if reaction == "" {
+		exec, err = db.Exec("DELETE FROM `reaction` WHERE `dec_msg`=? AND `user`=? AND `time`<?", id, user, at.UnixMilli())
+	} else {
+		exec, err = db.Exec("INSERT INTO `reaction` (`dec_msg`,`user`,`emoji`,`time`) VALUES (?,?,?,?) "+
+			"ON CONFLICT DO UPDATE SET `emoji`=`excluded`.`emoji`, `time`=`excluded`.`time` WHERE `excluded`.`time`>`reaction`.`time`",
+			id, user, reaction, at.UnixMilli())
+	}
+	if err != nil {
+		return false, err
+	}
+	affected, err := exec.RowsAffected()
+	return affected > 0, err
+}
+
+// applyReaction records a reaction received from a contact to a message of the conversation.
+func (db *database) applyReaction(conv conversation, target uint, env *envelope, sendTime time.Time) error {
+	cond, arg := conv.where("")
+	var id int64
+	err := db.QueryRow("SELECT ROWID FROM `dec_msg` WHERE "+cond+" AND `msg_id`=?", arg, env.Refs[0]).Scan(&id)
+	if err == sql.ErrNoRows {
+		log.WithField("target", target).Debug("[webui] reaction to unknown message ignored")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	changed, err := db.storeReaction(id, target, env.Reaction, sendTime)
+	if changed {
+		go web.msgChanged("reaction", conv, id)
+	}
+	return err
+}
+
+// reactions returns the reactions to the dec_msg rows (aliased `d`) matching the condition, by row ID.
+func (db *database) reactions(cond string, args ...interface{}) (map[int64][]reactionCount, error) {
+	query, err := db.Query("SELECT `r`.`dec_msg`, `r`.`emoji`, `r`.`user`, `u`.`key`, `u`.`alias` FROM `reaction` `r` "+
+		"JOIN `dec_msg` `d` ON `d`.ROWID=`r`.`dec_msg` LEFT JOIN `user` `u` ON `u`.`rowid`=`r`.`user` AND `r`.`user`>0 "+
+		"WHERE "+cond+" ORDER BY `r`.`time`", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+
+	ret := make(map[int64][]reactionCount)
+	for query.Next() {
+		var id int64
+		var emoji string
+		var user uint
+		var key []byte
+		var alias *string
+		if err = query.Scan(&id, &emoji, &user, &key, &alias); err != nil {
+			return nil, err
+		}
+
+		name := "You"
+		if alias != nil && *alias != "" {
+			name = *alias
+		} else if user > 0 {
+			name = nymo.ConvertAddrToStr(key)
+		}
+
+		counts := ret[id]
+		i := 0
+		for i < len(counts) && counts[i].Emoji != emoji {
+			i++
+		}
+		if i >= len(counts) {
+			counts = append(counts, reactionCount{Emoji: emoji})
+		}
+		counts[i].Count++
+		counts[i].Mine = counts[i].Mine || user == 0
+		counts[i].Names = append(counts[i].Names, name)
+		ret[id] = counts
+	}
+	return ret, query.Err()
+}
+
+// react sets (or removes) our reaction to a message, and sends it to the others in the conversation.
+func (w *webui) react(msg json.RawMessage) error {
+	var nm setReaction
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+	if err := validateReaction(nm.Reaction); err != nil {
+		return err
+	}
+
+	conv := nm.conversation
+	cond, arg := conv.where("")
+	var msgId []byte
+	err := w.db.QueryRow("SELECT `msg_id` FROM `dec_msg` WHERE "+cond+" AND ROWID=? AND `send_time` IS NOT NULL "+
+		"AND `msg_id` IS NOT NULL AND NOT `quarantine`", arg, nm.Id).Scan(&msgId)
+	if err == sql.ErrNoRows {
+		return errors.New("message cannot be reacted to")
+	} else if err != nil {
+		return err
+	}
+
+	env, err := newEnvelope(envelopeReaction)
+	if err != nil {
+		return err
+	}
+	env.Refs = [][]byte{msgId}
+	env.Reaction = nm.Reaction
+
+	var addresses []*nymo.Address
+	if conv.Group > 0 {
+		env.Group, addresses, err = w.lookupGroup(conv.Group)
+	} else {
+		var address *nymo.Address
+		_, address, err = w.lookupTargetId(conv.Target)
+		addresses = []*nymo.Address{address}
+	}
+	if err != nil {
+		return err
+	}
+	payload, err := env.marshal()
+	if err != nil {
+		return err
+	}
+
+	changed, err := w.db.storeReaction(nm.Id, 0, nm.Reaction, time.Now())
+	if err != nil || !changed {
+		return err
+	}
+
+	go func() {
+		w.msgChanged("reaction", conv, nm.Id)
+		for _, address := range addresses {
+			// authored by the message, so the reaction expires along with it
+			if err := w.sendPayload(address, payload, nm.Id); err != nil {
+				log.Warnf("[webui] sending reaction: %s", err)
+				w.broadcast("err", "Sending the reaction failed: "+err.Error())
+				return
+			}
+		}
+	}()
+	return nil
+}
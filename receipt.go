@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/nymo-net/nymo"
+)
+
+const (
+	receiptNone = iota
+	receiptDelivered
+	receiptRead
+)
+
+const maxReceiptRefs = 500
+
+type receiptUpdate struct {
+	Target uint    `json:"target"`
+	Ids    []int64 `json:"ids"`
+	Status int     `json:"status"`
+}
+
+type setReceipts struct {
+	Id      uint `json:"id"`
+	Enabled bool `json:"enabled"`
+}
+
+func validateRefs(refs [][]byte) error {
+	if len(refs) <= 0 || len(refs) > maxReceiptRefs {
+		return errors.New("invalid reference count")
+	}
+	for _, r := range refs {
+		if len(r) != msgIdSize {
+			return errors.New("invalid message reference")
+		}
+	}
+	return nil
+}
+
+// sendReceipt tells an accepted contact with receipts enabled that its messages reached the given status.
+func (w *webui) sendReceipt(target uint, status int, ids [][]byte) {
+	row := w.db.QueryRow("SELECT `key` FROM `user` WHERE `rowid`=? AND `state`=? AND `receipts`", target, contactAccepted)
+	var key []byte
+	if err := row.Scan(&key); err != nil {
+		if err != sql.ErrNoRows {
+			log.Errorf("[webui, db] %s", err)
+		}
+		return
+	}
+	address := nymo.NewAddressFromBytes(key)
+	if address == nil {
+		log.Fatal("[webui, db] invalid receiver address")
+	}
+
+	for len(ids) > 0 {
+		refs := ids
+		if len(refs) > maxReceiptRefs {
+			refs = refs[:maxReceiptRefs]
+		}
+		ids = ids[len(refs):]
+
+		payload, err := (&envelope{
+			Version: envelopeVersion,
+			Type:    envelopeReceipt,
+			Receipt: status,
+			Refs:    refs,
+		}).marshal()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = w.sendPayload(address, payload, 0); err != nil {
+			log.Warnf("[webui] sending receipt: %s", err)
+			return
+		}
+	}
+}
+
+// applyReceipt records a receipt for our messages, and returns the updated row IDs.
+func (db *database) applyReceipt(target uint, env *envelope) ([]int64, error) {
+	args := []interface{}{target, env.Receipt}
+	for _, r := range env.Refs {
+		args = append(args, r)
+	}
+	query, err := db.Query("SELECT ROWID FROM `dec_msg` WHERE `target`=? AND `self` AND `receipt`<? AND `msg_id` IN "+
+		sqlIn(len(env.Refs)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+
+	var ids []int64
+	for query.Next() {
+		var id int64
+		if err = query.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err = query.Err(); err != nil || len(ids) <= 0 {
+		return nil, err
+	}
+
+	args = []interface{}{env.Receipt}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	_, err = db.Exec("UPDATE `dec_msg` SET `receipt`=? WHERE ROWID IN "+sqlIn(len(ids)), args...)
+	return ids, err
+}
+
+// markRead marks the received messages of a conversation as read, and sends read receipts for direct messages.
+func (w *webui) markRead(conv conversation) error {
+	cond, arg := conv.where("")
+	query, err := w.db.Query("SELECT `msg_id` FROM `dec_msg` "+
+		"WHERE "+cond+" AND NOT `self` AND `receipt`<? AND NOT `quarantine` AND `msg_id` IS NOT NULL",
+		arg, receiptRead)
+	if err != nil {
+		return err
+	}
+	defer query.Close()
+
+	var ids [][]byte
+	for query.Next() {
+		var id []byte
+		if err = query.Scan(&id); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err = query.Err(); err != nil {
+		return err
+	}
+
+	var until *int64
+	err = w.db.QueryRow("SELECT MAX(`send_time`) FROM `dec_msg` WHERE "+cond+" AND NOT `self` AND `receipt`<? AND NOT `quarantine`",
+		arg, receiptRead).Scan(&until)
+	if err != nil || until == nil {
+		return err
+	}
+
+	_, err = w.db.Exec("UPDATE `dec_msg` SET `receipt`=? WHERE "+cond+" AND NOT `self` AND `receipt`<? AND NOT `quarantine` AND `send_time`<=?",
+		receiptRead, arg, receiptRead, *until)
+	if err != nil {
+		return err
+	}
+	go w.syncRead(conv, *until)
+	if len(ids) > 0 && conv.Group <= 0 {
+		go w.sendReceipt(conv.Target, receiptRead, ids)
+	}
+	return nil
+}
+
+func (w *webui) readMessages(msg json.RawMessage) error {
+	conv, err := parseConversation(msg)
+	if err != nil {
+		return err
+	}
+	return w.markRead(conv)
+}
+
+func (w *webui) setReceipts(msg json.RawMessage) error {
+	var nm setReceipts
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+
+	_, err := w.db.Exec("UPDATE `user` SET `receipts`=? WHERE `rowid`=?", nm.Enabled, nm.Id)
+	if err != nil {
+		return err
+	}
+
+	go w.broadcast("receipts", nm)
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/nymo-net/nymo"
+)
+
+const (
+	scheduleInterval = 5 * time.Second
+	maxSchedule      = 365 * 24 * time.Hour
+)
+
+// scheduledMessage is a message waiting to be sent at SendAt (unix milliseconds).
+type scheduledMessage struct {
+	conversation
+	Id      int64  `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Message string `json:"message"`
+	SendAt  int64  `json:"send_at"`
+	Content string `json:"content,omitempty"`
+}
+
+// scheduleTime returns the time to send a message at, or nil if it is to be sent right away.
+func scheduleTime(sendAt int64) (*time.Time, error) {
+	if sendAt <= 0 {
+		return nil, nil
+	}
+	t := time.UnixMilli(sendAt)
+	now := time.Now()
+	if !t.After(now) {
+		return nil, nil
+	}
+	if t.Sub(now) > maxSchedule {
+		return nil, errors.New("scheduled too far ahead")
+	}
+	return &t, nil
+}
+
+// scheduledRender returns a scheduled message as rendered in the history, along with its conversation.
+func (db *database) scheduledRender(id int64) (conversation, msgRender, error) {
+	var conv conversation
+	var replyRow *int64
+	var sendAt int64
+	var contentType string
+	r := msgRender{Id: id, Self: true}
+	err := db.QueryRow("SELECT `target`, IFNULL(`group`, 0), `content`, `content_type`, `reply_row`, `send_at` FROM `dec_msg` "+
+		"WHERE ROWID=? AND `self` AND `send_at` IS NOT NULL", id).Scan(&conv.Target, &conv.Group, &r.Content, &contentType, &replyRow, &sendAt)
+	if err != nil {
+		return conv, r, err
+	}
+	r.Markdown = contentType == mimeMarkdown
+	r.SendAt = new(time.Time)
+	*r.SendAt = time.UnixMilli(sendAt)
+	if replyRow != nil {
+		r.Quote, _, err = db.getQuote(conv, *replyRow)
+	}
+	return conv, r, err
+}
+
+// listScheduled returns all scheduled messages, the next one first.
+func (w *webui) listScheduled() ([]scheduledMessage, error) {
+	query, err := w.db.Query("SELECT `d`.ROWID, `d`.`target`, IFNULL(`d`.`group`, 0), `d`.`content`, `d`.`send_at`, `g`.`name` " +
+		"FROM `dec_msg` `d` LEFT JOIN `group` `g` ON `g`.`rowid`=`d`.`group` " +
+		"WHERE `d`.`self` AND `d`.`send_at` IS NOT NULL AND `d`.`sending` IS NULL ORDER BY `d`.`send_at`")
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []scheduledMessage
+	for query.Next() {
+		var m scheduledMessage
+		var name *string
+		if err = query.Scan(&m.Id, &m.Target, &m.Group, &m.Message, &m.SendAt, &name); err != nil {
+			_ = query.Close()
+			return nil, err
+		}
+		if name != nil {
+			m.Name = *name
+		}
+		ret = append(ret, m)
+	}
+	if err = query.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range ret {
+		if ret[i].Group > 0 {
+			if ret[i].Name == "" {
+				ret[i].Name = "Group"
+			}
+			continue
+		}
+		if ret[i].Name, err = w.db.senderName(ret[i].Target); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+func (w *webui) editScheduled(msg json.RawMessage) error {
+	var nm scheduledMessage
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+	nm.Message = strings.TrimSpace(nm.Message)
+	if nm.Message == "" {
+		return errors.New("empty message")
+	}
+	sendAt, err := scheduleTime(nm.SendAt)
+	if err != nil {
+		return err
+	}
+	if sendAt == nil {
+		// due right away, the scheduler picks it up
+		sendAt = new(time.Time)
+		*sendAt = time.Now()
+	}
+
+	exec, err := w.db.Exec("UPDATE `dec_msg` SET `content`=?, `send_at`=? WHERE ROWID=? AND `self` AND `send_at` IS NOT NULL AND `sending` IS NULL",
+		nm.Message, sendAt.UnixMilli(), nm.Id)
+	if err != nil {
+		return err
+	}
+	if affected, err := exec.RowsAffected(); err != nil || affected <= 0 {
+		if err == nil {
+			err = errors.New("message is not scheduled anymore")
+		}
+		return err
+	}
+
+	conv, r, err := w.db.scheduledRender(nm.Id)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err = indexTpl.ExecuteTemplate(&buf, "message", r); err != nil {
+		log.Fatalf("[webui, template] %s", err)
+	}
+	go w.broadcast("msg_scheduled", scheduledMessage{
+		conversation: conv,
+		Id:           nm.Id,
+		Message:      nm.Message,
+		SendAt:       sendAt.UnixMilli(),
+		Content:      buf.String(),
+	})
+	return nil
+}
+
+// sendScheduled sends a due message, building its payload from the stored row.
+func (w *webui) sendScheduled(id int64) error {
+	conv, r, err := w.db.scheduledRender(id)
+	if err == sql.ErrNoRows {
+		// cancelled meanwhile
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// claim the row first, so it is neither sent twice nor edited while sending. It stays scheduled until sent, see
+	// deliverMessage, so a send interrupted by a crash is retried by requeueScheduled.
+	exec, err := w.db.Exec("UPDATE `dec_msg` SET `sending`=? WHERE ROWID=? AND `send_at` IS NOT NULL AND `sending` IS NULL",
+		time.Now().UnixMilli(), id)
+	if err != nil {
+		return err
+	}
+	if affected, err := exec.RowsAffected(); err != nil || affected <= 0 {
+		return err
+	}
+	r.SendAt = nil
+
+	env := &envelope{Type: envelopeText, Text: r.Content}
+	err = w.db.QueryRow("SELECT `version`, `msg_id`, `content_type`, `reply_to`, `expire` FROM `dec_msg` WHERE ROWID=?", id).
+		Scan(&env.Version, &env.Id, &env.ContentType, &env.ReplyTo, &env.Expire)
+	if err != nil {
+		return err
+	}
+
+	var addresses []*nymo.Address
+	if conv.Group > 0 {
+		conv.Target = 0
+		env.Group, addresses, err = w.lookupGroup(conv.Group)
+	} else {
+		var address *nymo.Address
+		_, address, err = w.lookupTargetId(conv.Target)
+		addresses = []*nymo.Address{address}
+	}
+	var payload []byte
+	if err == nil {
+		payload, err = env.marshal()
+	}
+	if err != nil {
+		if _, e := w.db.Exec("DELETE FROM `dec_msg` WHERE ROWID=?", id); e != nil {
+			return e
+		}
+		w.msgSent(conv, id, r.Content, "", err)
+		return nil
+	}
+
+	w.deliverMessage(conv, addresses, r, [][]byte{payload})
+	return nil
+}
+
+func (w *webui) sendDue() error {
+	query, err := w.db.Query("SELECT ROWID FROM `dec_msg` WHERE `send_at`<=? AND `sending` IS NULL ORDER BY `send_at`", time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	var due []int64
+	for query.Next() {
+		var id int64
+		if err = query.Scan(&id); err != nil {
+			_ = query.Close()
+			return err
+		}
+		due = append(due, id)
+	}
+	if err = query.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range due {
+		if err = w.sendScheduled(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requeueScheduled releases the messages claimed for sending by a previous run, which did not finish sending them.
+// Recipients drop the copies they already got by their message ID.
+func (db *database) requeueScheduled() error {
+	exec, err := db.Exec("UPDATE `dec_msg` SET `sending`=NULL WHERE `sending` IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	if n, err := exec.RowsAffected(); err == nil && n > 0 {
+		log.Infof("[webui] requeued %d interrupted scheduled messages", n)
+	}
+	return nil
+}
+
+// runScheduler sends scheduled messages when they are due, until ctx is done.
+func (w *webui) runScheduler(ctx context.Context) {
+	if err := w.db.requeueScheduled(); err != nil {
+		log.Errorf("[webui, db] requeueing scheduled messages: %s", err)
+	}
+
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.sendDue(); err != nil {
+			log.Errorf("[webui, db] sending scheduled messages: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nymo-net/nymo"
+)
+
+const (
+	mimeContact      = "application/x-nymo-contact"
+	maxCardNameRunes = 100
+)
+
+// previewContent selects the content of a dec_msg row as shown in the contact list.
+const previewContent = "CASE WHEN `content_type`='" + mimeContact + "' THEN 'Contact card' ELSE `content` END AS `content`"
+
+// contactCard shares a contact in a conversation. It is signed by the identity vouching for the contact, which is
+// kept when the card is forwarded.
+type contactCard struct {
+	Address   []byte `json:"address"`
+	Name      string `json:"name,omitempty"`
+	Signer    []byte `json:"signer"`
+	Signature []byte `json:"signature"`
+}
+
+type shareContact struct {
+	conversation
+	Contact uint `json:"contact"`
+}
+
+type addContact struct {
+	Addr string `json:"addr"`
+	Name string `json:"name,omitempty"`
+}
+
+func (c *contactCard) digest() []byte {
+	h := sha256.New()
+	h.Write([]byte("nymo contact card\x00"))
+	h.Write(c.Address)
+	h.Write([]byte{0})
+	h.Write([]byte(c.Name))
+	return h.Sum(nil)
+}
+
+func (c *contactCard) sign(userKey []byte, signer *nymo.Address) error {
+	curve := elliptic.P256()
+	key := &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: curve}, D: new(big.Int).SetBytes(userKey)}
+	key.X, key.Y = curve.ScalarBaseMult(userKey)
+
+	c.Signer = signer.Bytes()
+	var err error
+	c.Signature, err = ecdsa.SignASN1(rand.Reader, key, c.digest())
+	return err
+}
+
+func (c *contactCard) validate() error {
+	if nymo.NewAddressFromBytes(c.Address) == nil {
+		return errors.New("invalid contact address")
+	}
+	if !utf8.ValidString(c.Name) || utf8.RuneCountInString(c.Name) > maxCardNameRunes {
+		return errors.New("invalid contact name")
+	}
+	x, y := elliptic.UnmarshalCompressed(elliptic.P256(), c.Signer)
+	if x == nil {
+		return errors.New("invalid card signer")
+	}
+	if !ecdsa.VerifyASN1(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, c.digest(), c.Signature) {
+		return errors.New("invalid card signature")
+	}
+	return nil
+}
+
+// AddressStr returns the address of the shared contact.
+func (c *contactCard) AddressStr() string {
+	return nymo.ConvertAddrToStr(c.Address)
+}
+
+// SignerStr returns the address of the identity vouching for the contact.
+func (c *contactCard) SignerStr() string {
+	return nymo.ConvertAddrToStr(c.Signer)
+}
+
+// cardOf returns the contact card of a message, or nil if it is none or it is not validly signed.
+func cardOf(contentType, content string) *contactCard {
+	if contentType != mimeContact {
+		return nil
+	}
+	c := new(contactCard)
+	if err := json.Unmarshal([]byte(content), c); err != nil || c.validate() != nil {
+		return nil
+	}
+	return c
+}
+
+// shareContact sends a contact card, signed by us, to a conversation.
+func (w *webui) shareContact(msg json.RawMessage) error {
+	var nm shareContact
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+
+	card := new(contactCard)
+	var alias *string
+	err := w.db.QueryRow("SELECT `key`, `alias` FROM `user` WHERE `rowid`=? AND `rowid`>0", nm.Contact).Scan(&card.Address, &alias)
+	if err != nil {
+		return err
+	}
+	if alias != nil {
+		card.Name = *alias
+		if utf8.RuneCountInString(card.Name) > maxCardNameRunes {
+			card.Name = string([]rune(card.Name)[:maxCardNameRunes])
+		}
+	}
+
+	key, err := w.db.getUserKey()
+	if err != nil {
+		return err
+	}
+	if err = card.sign(key, w.user.Address()); err != nil {
+		return err
+	}
+	content, err := json.Marshal(card)
+	if err != nil {
+		return err
+	}
+
+	var target interface{}
+	if nm.Target > 0 {
+		target = float64(nm.Target)
+	}
+	return w.sendText(&newMessage{Target: target, Group: nm.Group, Message: string(content), card: card}, false)
+}
+
+// addContact adds the contact of a shared address link, naming it unless it has an alias already.
+func (w *webui) addContact(msg json.RawMessage) (uint, error) {
+	var nm addContact
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return 0, err
+	}
+	addr := nymo.NewAddress(nm.Addr)
+	if addr == nil {
+		return 0, errors.New("invalid address")
+	}
+	if addr.String() == w.user.Address().String() {
+		return 0, errors.New("cannot add ourselves")
+	}
+
+	id, err := w.db.lookupUserId(addr.Bytes(), contactAccepted)
+	if err != nil {
+		return 0, err
+	}
+	if err = w.acceptContact(id); err != nil {
+		return 0, err
+	}
+
+	name := strings.TrimSpace(nm.Name)
+	if name == "" {
+		return id, nil
+	}
+	exec, err := w.db.Exec("UPDATE `user` SET `alias`=? WHERE `rowid`=? AND IFNULL(`alias`, '')=''", name, id)
+	if err != nil {
+		return 0, err
+	}
+	if affected, err := exec.RowsAffected(); err != nil || affected <= 0 {
+		return id, err
+	}
+	go w.broadcast("alias", setAlias{Id: id, Name: &name})
+	return id, nil
+}
+
+// serveAdd handles shared address links (/add?addr=...&name=...). The address is checked and handed to the web UI,
+// which asks before adding the contact.
+func (w *webui) serveAdd(wr http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	// links handed over by the browser for the web+nymo scheme
+	addr := nymo.NewAddress(strings.TrimPrefix(q.Get("addr"), "web+"))
+	if addr == nil {
+		http.Error(wr, "invalid address", http.StatusBadRequest)
+		return
+	}
+
+	v := url.Values{"add": {addr.String()}}
+	if name := strings.TrimSpace(q.Get("name")); name != "" {
+		v.Set("name", name)
+	}
+	http.Redirect(wr, r, "/#"+v.Encode(), http.StatusSeeOther)
+}
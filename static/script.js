@@ -14,11 +14,30 @@ function htmlToElement(html) {
 document.addEventListener('DOMContentLoaded', function () {
     let last_target;
 
+    const contact_list = document.getElementById('contact-list');
     const contacts = document.getElementById('contacts');
+    const requests = document.getElementById('requests');
+    const blocked = document.getElementById('blocked');
+    const archived = document.getElementById('archived');
+    const conv_flags = document.getElementById('conv-flags');
+    const contact_actions = document.getElementById('contact-actions');
+    const receipts_switch = document.getElementById('receipts-switch');
+    const receipts_toggle = document.getElementById('receipts-toggle');
+    const expiry_select = document.getElementById('expiry-select');
+    const delete_btn = document.getElementById('delete-btn');
+    const verify_btn = document.getElementById('verify-btn');
+    const details_btn = document.getElementById('details-btn');
+    const share_btn = document.getElementById('share-btn');
+    const tag_filter = document.getElementById('tag-filter');
     const chat = document.getElementById('chat');
     const history = document.getElementById('history');
+    const chat_input = document.getElementById('chat-input');
     const chat_title = document.querySelector('div.card-header > h3');
     const alert_container = document.querySelector('div.alert-container');
+    const reply_bar = document.getElementById('reply-bar');
+    const edit_msg = document.getElementById('edit-msg');
+    const retract_msg = document.getElementById('retract-msg');
+    let reply_to;
 
     const status_modal = document.getElementById('status');
     const modal_comp = new bootstrap.Modal(status_modal);
@@ -27,6 +46,48 @@ document.addEventListener('DOMContentLoaded', function () {
     const servers_list = document.getElementById('servers');
     const peers_list = document.getElementById('peers');
     const version_text = status_modal.getElementsByClassName('text-center')[0];
+    const address_qr = document.getElementById('address-qr');
+    const previews_switch = document.getElementById('previews-switch');
+    const sync_switch = document.getElementById('sync-switch');
+    const notify_btn = document.getElementById('notify-btn');
+
+    const rules_modal = new bootstrap.Modal(document.getElementById('rules-modal'));
+    const rules_list = document.getElementById('rules');
+
+    const scheduled_modal_ele = document.getElementById('scheduled-modal');
+    const scheduled_modal = new bootstrap.Modal(scheduled_modal_ele);
+    const scheduled_list = document.getElementById('scheduled');
+    const send_at = document.getElementById('send-at');
+
+    const markdown_switch = document.getElementById('markdown-switch');
+    markdown_switch.checked = localStorage.getItem('markdown') === 'true';
+    markdown_switch.addEventListener('change', () => localStorage.setItem('markdown', markdown_switch.checked));
+
+    const edit_modal = new bootstrap.Modal(document.getElementById('edit-modal'));
+    const edit_text = document.getElementById('edit-text');
+    const edit_markdown = document.getElementById('edit-markdown');
+    let editing_msg;
+
+    const share_modal = new bootstrap.Modal(document.getElementById('share-modal'));
+    const share_contact = document.getElementById('share-contact');
+
+    const versions_modal = new bootstrap.Modal(document.getElementById('versions-modal'));
+    const versions_list = document.getElementById('versions');
+
+    const verify_modal = new bootstrap.Modal(document.getElementById('verify-modal'));
+    const fingerprint_text = document.getElementById('fingerprint');
+    const fingerprint_qr = document.getElementById('fingerprint-qr');
+    const verified_switch = document.getElementById('verified-switch');
+
+    const details_modal = new bootstrap.Modal(document.getElementById('details-modal'));
+    const details_avatar = document.getElementById('details-avatar');
+    const details_tags = document.getElementById('details-tags');
+    const details_note = document.getElementById('details-note');
+
+    const group_modal = new bootstrap.Modal(document.getElementById('group-modal'));
+    const group_name = document.getElementById('group-name');
+    const group_members = document.getElementById('group-members');
+    let editing_group;
 
     function create_alert(content, timeout = 3000) {
         const alert = htmlToElement(`<div class="alert alert-danger alert-dismissible fade show" role="alert">
@@ -37,28 +98,106 @@ ${content}<button type="button" class="btn-close" data-bs-dismiss="alert" aria-l
 
     ws.register('err', create_alert);
 
-    ws.register('history', function ({id, content}) {
-        if (current_target()?.dataset.id == id)
-            history.innerHTML = content;
+    ws.register('history', function ({id, group, content, draft}) {
+        const ele = find_conv({target: id, group});
+        if (!ele?.classList.contains('active')) return;
+        history.innerHTML = content;
+        chat_input.value = draft ?? '';
+        resize_input();
+        // loading the history is not reading it, unless shown
+        if (!document.hidden) ws.send('read', conv_of(ele));
     });
 
-    ws.register('new_msg', function ({target, message, content}) {
-        const ele = contacts.querySelector(`button.list-group-item[data-id="${target}"]`);
-        if (ele.classList.contains('active'))
+    let draft_timer, draft_conv;
+
+    // save_draft sends the pending draft right away
+    function save_draft() {
+        clearTimeout(draft_timer);
+        if (draft_conv) ws.send('draft', {...draft_conv, draft: chat_input.value});
+        draft_conv = undefined;
+    }
+
+    function find_contact(id) {
+        return contact_list.querySelector(`button.list-group-item[data-id="${id}"]`);
+    }
+
+    function find_group(id) {
+        return contact_list.querySelector(`button.list-group-item[data-group="${id}"]`);
+    }
+
+    // find_conv returns the button of the conversation a message belongs to
+    function find_conv({target, group}) {
+        return group ? find_group(group) : find_contact(target);
+    }
+
+    // conv_of returns the conversation of a button as sent to the server
+    function conv_of(btn) {
+        return btn.dataset.group ? {group: parseInt(btn.dataset.group)} : parseInt(btn.dataset.id);
+    }
+
+    function place_contact(btn) {
+        const list = {'1': requests, '2': blocked}[btn.dataset.state] ?? (btn.dataset.archived ? archived : contacts);
+        const others = [...list.children].filter(e => e !== btn);
+        // pinned conversations stay on top and muted ones at the bottom, as ordered by the server
+        const before = btn.dataset.pinned ? others[0] :
+            others.find(e => !e.dataset.pinned && (!btn.dataset.muted || e.dataset.muted));
+        list.insertBefore(btn, before ?? null);
+        for (const l of [requests, blocked, archived])
+            l.parentElement.hidden = !l.childElementCount;
+    }
+
+    function update_flags(btn) {
+        for (const b of conv_flags.children)
+            b.classList.toggle('active', !!btn.dataset[b.dataset.flag]);
+    }
+
+    for (const b of conv_flags.children) {
+        b.addEventListener('click', function () {
+            const current = current_target();
+            if (!current) return;
+            const conv = current.dataset.group ? {group: parseInt(current.dataset.group)} : {target: parseInt(current.dataset.id)};
+            ws.send(this.dataset.op, {...conv, value: !current.dataset[this.dataset.flag]});
+        });
+
+        ws.register(b.dataset.op, function ({target, group, value}) {
+            const ele = find_conv({target, group});
+            if (!ele) return;
+
+            if (value) ele.dataset[b.dataset.flag] = 'true';
+            else delete ele.dataset[b.dataset.flag];
+            update_name(ele);
+            place_contact(ele);
+            if (ele.classList.contains('active')) update_flags(ele);
+        });
+    }
+
+    function update_actions(btn) {
+        for (const action of contact_actions.children)
+            action.hidden = !action.dataset.show.split(' ').includes(btn?.dataset.state);
+    }
+
+    ws.register('new_msg', function ({target, group, message, content, quarantine}) {
+        const ele = find_conv({target, group});
+        if (!ele) return;
+        if (ele.classList.contains('active')) {
             history.insertAdjacentHTML('afterbegin', content);
+            if (!document.hidden) ws.send('read', conv_of(ele));
+        }
         if (message) {
             ele.dataset.message = message;
             update_name(ele);
         }
-        contacts.prepend(ele);
+        // muted conversations do not move up on new messages, and stay archived (see unarchive on the server)
+        if (!quarantine && !ele.dataset.muted) place_contact(ele);
     });
 
     ws.register('msg_sent', function (data) {
         if (data.err) {
             create_alert(data.err);
         }
+        refresh_scheduled();
         const ele = current_target();
-        if (ele?.dataset.id != data.target) return;
+        if (!ele || ele !== find_conv(data)) return;
         history.querySelector(`div.justify-content-end[data-id="${data.id}"]`)?.remove();
         if (data.content)
             history.insertAdjacentHTML('afterbegin', data.content);
@@ -68,10 +207,14 @@ ${content}<button type="button" class="btn-close" data-bs-dismiss="alert" aria-l
         }
     });
 
-    ws.register('meta', function ({version, address, servers, peers}) {
+    ws.register('meta', function ({version, address, servers, peers, previews, sync}) {
         version_text.innerText = version;
+        previews_switch.checked = previews;
+        sync_switch.checked = sync;
+        update_notify_btn();
+        address_qr.src = '/qr';
         address_field.innerText = address;
-        address_field.href = address;
+        address_field.href = `/add?addr=${encodeURIComponent(address)}`;
         servers_list.innerHTML = '';
         servers?.forEach(e => {
             const li = document.createElement('li');
@@ -90,7 +233,12 @@ ${content}<button type="button" class="btn-close" data-bs-dismiss="alert" aria-l
     });
 
     function update_name(btn) {
-        if (btn.dataset.alias) {
+        if (btn.dataset.group) {
+            const ele = document.createElement('b');
+            ele.innerText = btn.dataset.alias || 'Group';
+            btn.innerText = ` (${member_ids(btn).length} members)`;
+            btn.insertAdjacentElement('afterbegin', ele);
+        } else if (btn.dataset.alias) {
             const ele = document.createElement('b');
             ele.innerText = btn.dataset.alias;
             btn.innerText = ` (${btn.dataset.addr})`;
@@ -98,6 +246,25 @@ ${content}<button type="button" class="btn-close" data-bs-dismiss="alert" aria-l
         } else {
             btn.innerText = `(${btn.dataset.addr})`;
         }
+        if (btn.dataset.verified)
+            btn.insertAdjacentHTML('afterbegin', '<span class="badge bg-success me-1" title="Verified">&check;</span>');
+        if (btn.dataset.muted)
+            btn.insertAdjacentHTML('afterbegin', '<span class="me-1" title="Muted">&#x1F515;</span>');
+        if (btn.dataset.pinned)
+            btn.insertAdjacentHTML('afterbegin', '<span class="me-1" title="Pinned">&#x1F4CC;</span>');
+        if (btn.dataset.avatar) {
+            const img = document.createElement('img');
+            img.className = 'avatar rounded-circle me-2';
+            img.alt = '';
+            img.src = `/avatar?id=${btn.dataset.id}&v=${btn.dataset.avatar}`;
+            btn.insertAdjacentElement('afterbegin', img);
+        }
+        for (const tag of tags_of(btn)) {
+            const badge = document.createElement('span');
+            badge.className = 'badge rounded-pill bg-secondary ms-1';
+            badge.innerText = tag;
+            btn.append(badge);
+        }
         if (btn.dataset.message) {
             const node = document.createElement('p');
             node.className = 'm-0 small';
@@ -106,8 +273,43 @@ ${content}<button type="button" class="btn-close" data-bs-dismiss="alert" aria-l
         }
     }
 
+    function tags_of(btn) {
+        return btn.dataset.tags ? btn.dataset.tags.split(',') : [];
+    }
+
+    function update_tag_filter() {
+        const tags = new Set();
+        for (const btn of contact_list.querySelectorAll('button[data-tags]'))
+            tags_of(btn).forEach(t => tags.add(t));
+        const selected = tag_filter.value;
+        while (tag_filter.options.length > 1) tag_filter.lastElementChild.remove();
+        for (const tag of [...tags].sort()) {
+            const option = document.createElement('option');
+            option.value = option.innerText = tag;
+            tag_filter.append(option);
+        }
+        tag_filter.value = tags.has(selected) ? selected : '';
+        tag_filter.hidden = !tags.size;
+        filter_contacts();
+    }
+
+    function filter_contacts() {
+        const tag = tag_filter.value;
+        for (const btn of contact_list.getElementsByClassName('list-group-item'))
+            btn.hidden = tag !== '' && !tags_of(btn).includes(tag);
+    }
+
+    tag_filter.addEventListener('change', filter_contacts);
+
+    function member_ids(btn) {
+        return btn.dataset.members ? btn.dataset.members.split(',').map(Number) : [];
+    }
+
     function update_title(btn) {
-        if (btn.dataset.alias) {
+        if (btn.dataset.group) {
+            chat_title.innerHTML = ` <small class='text-muted'>(${member_ids(btn).length} members)</small>`;
+            chat_title.insertAdjacentText('afterbegin', btn.dataset.alias || 'Group');
+        } else if (btn.dataset.alias) {
             chat_title.innerHTML = ` <small class='text-muted'>(${btn.dataset.addr})</small>`;
             chat_title.insertAdjacentText('afterbegin', btn.dataset.alias);
         } else {
@@ -115,79 +317,890 @@ ${content}<button type="button" class="btn-close" data-bs-dismiss="alert" aria-l
         }
     }
 
+    function set_reply(msg) {
+        reply_to = msg && parseInt(msg.dataset.id);
+        reply_bar.hidden = !msg;
+        if (msg) reply_bar.firstElementChild.innerText = 'Reply to: ' + msg.querySelector('.rounded').innerText;
+        edit_msg.hidden = msg?.dataset.text === undefined;
+        retract_msg.hidden = !msg?.hasAttribute('data-own');
+    }
+
+    reply_bar.lastElementChild.addEventListener('click', () => set_reply());
+
+    history.addEventListener('click', function (e) {
+        const quote = e.target.closest('a[data-quote]');
+        if (quote) {
+            e.preventDefault();
+            const ori = history.querySelector(`div[data-id="${quote.dataset.quote}"]`);
+            ori?.scrollIntoView({behavior: 'smooth', block: 'center'});
+            ori?.classList.add('highlight');
+            setTimeout(() => ori?.classList.remove('highlight'), 1500);
+            return;
+        }
+        const reaction = e.target.closest('button[data-react]');
+        if (reaction) {
+            const id = parseInt(reaction.closest('div[data-id]').dataset.id);
+            ws.send('react', {...msg_of(id), reaction: 'mine' in reaction.dataset ? '' : reaction.dataset.react});
+            return;
+        }
+        const trace = e.target.closest('a[data-trace]');
+        if (trace) {
+            e.preventDefault();
+            ws.send('trace', parseInt(trace.dataset.trace));
+            return;
+        }
+        const edits = e.target.closest('a[data-edits]');
+        if (edits) {
+            e.preventDefault();
+            ws.send('edits', parseInt(edits.dataset.edits));
+            return;
+        }
+        const add_card = e.target.closest('button[data-add-addr]');
+        if (add_card) {
+            add_contact(add_card.dataset.addAddr, add_card.dataset.addName);
+            return;
+        }
+        const chat_link = e.target.closest('a[data-chat]');
+        if (chat_link) {
+            e.preventDefault();
+            open_chat(chat_link.dataset.chat);
+            return;
+        }
+        if (e.target.closest('a, summary')) return;
+        const msg = e.target.closest('div[data-id]');
+        if (msg && !msg.querySelector('.spinner-border')) set_reply(msg);
+    });
+
     function listen_button(btn) {
         update_name(btn);
 
         btn.addEventListener('click', function () {
             const current = current_target();
             if (current === this) return;
+            save_draft();
+            chat_input.value = '';
+            resize_input();
             if (current) current.classList.remove('active');
             else chat.style.removeProperty('display');
             history.innerHTML = '';
-            ws.send('history', parseInt(this.dataset.id));
+            set_reply();
+            ws.send('history', conv_of(this));
             this.classList.add('active');
             update_title(this);
+            update_actions(this);
+            receipts_toggle.hidden = !!this.dataset.group;
+            receipts_switch.checked = this.dataset.receipts === 'true';
+            update_expiry(this);
+            update_flags(this);
+            delete_btn.hidden = verify_btn.hidden = details_btn.hidden = !!this.dataset.group;
         });
     }
 
     ws.register('new_user', function (content) {
         const button = htmlToElement(content);
         listen_button(button);
-        contacts.prepend(button);
+        place_contact(button);
         if (button.dataset.addr === last_target) {
             last_target = undefined;
             button.click();
         }
     });
 
-    for (const item of contacts.getElementsByClassName('list-group-item')) {
+    ws.register('new_group', function (content) {
+        const button = htmlToElement(content);
+        listen_button(button);
+        contacts.prepend(button);
+        if (editing_group === null) {
+            editing_group = undefined;
+            button.click();
+        }
+    });
+
+    ws.register('group', function ({id, name, members}) {
+        const ele = find_group(id);
+        if (!ele) return;
+
+        ele.dataset.alias = name;
+        ele.dataset.members = members?.join(',') ?? '';
+        update_name(ele);
+        if (ele.classList.contains('active'))
+            update_title(ele);
+    });
+
+    function open_group(btn) {
+        editing_group = btn;
+        group_name.value = btn?.dataset.alias ?? '';
+        const members = btn ? member_ids(btn) : [];
+        group_members.innerHTML = '';
+        for (const c of contact_list.querySelectorAll('#contacts [data-id], #requests [data-id]')) {
+            const label = document.createElement('label');
+            label.className = 'list-group-item text-truncate';
+            const check = document.createElement('input');
+            check.type = 'checkbox';
+            check.className = 'form-check-input me-2';
+            check.value = c.dataset.id;
+            check.checked = members.includes(parseInt(c.dataset.id));
+            label.append(check, c.dataset.alias || c.dataset.addr);
+            group_members.append(label);
+        }
+        group_modal.show();
+    }
+
+    document.getElementById('group-btn').addEventListener('click', () => open_group());
+
+    document.getElementById('group-save').addEventListener('click', function () {
+        const members = [...group_members.querySelectorAll('input:checked')].map(e => parseInt(e.value));
+        const name = group_name.value.trim();
+        if (editing_group) {
+            ws.send('group_update', {id: parseInt(editing_group.dataset.group), name, members});
+        } else {
+            // the new group is opened once the server announces it
+            editing_group = null;
+            ws.send('group_create', {name, members});
+        }
+        group_modal.hide();
+    });
+
+    for (const item of contact_list.getElementsByClassName('list-group-item')) {
         listen_button(item);
     }
+    update_tag_filter();
 
-    const chat_input = document.getElementById('chat-input');
-    chat_input.addEventListener('input', function () {
-        if (this.value === '') {
-            this.style.height = '1em';
+    function resize_input() {
+        if (chat_input.value === '') {
+            chat_input.style.height = '1em';
         } else {
-            this.style.height = 'auto';
-            this.style.height = (this.scrollHeight) + 'px';
+            chat_input.style.height = 'auto';
+            chat_input.style.height = (chat_input.scrollHeight) + 'px';
         }
+    }
+
+    chat_input.addEventListener('input', function () {
+        resize_input();
+        const current = current_target();
+        if (!current) return;
+        // drafts are saved once typing pauses
+        clearTimeout(draft_timer);
+        draft_conv = current.dataset.group ? {group: parseInt(current.dataset.group)} : {target: parseInt(current.dataset.id)};
+        draft_timer = setTimeout(save_draft, 1000);
+    });
+
+    window.addEventListener('pagehide', save_draft);
+
+    ws.register('draft', function ({target, group, draft}) {
+        if (!find_conv({target, group})?.classList.contains('active') || document.activeElement === chat_input) return;
+        chat_input.value = draft;
+        resize_input();
     });
 
     document.getElementById('chat-send').addEventListener('click', function () {
         const val = chat_input.value;
         if (!val) return;
-        let target;
+        let target, group;
         const current = current_target();
-        if (current) {
+        if (current?.dataset.group) {
+            group = parseInt(current.dataset.group);
+        } else if (current) {
             target = parseInt(current.dataset.id);
         } else {
             const input = chat_title.firstChild;
             if (input?.tagName !== 'INPUT') return;
             target = input.value.trim();
             input.value = '';
-            const ele = contacts.querySelector(`button.list-group-item[data-addr="${target}"]`);
+            const ele = contact_list.querySelector(`button.list-group-item[data-addr="${target}"]`);
             if (ele) ele.click();
             else last_target = target;
         }
+        // the server drops the draft of the conversation
+        clearTimeout(draft_timer);
+        draft_conv = undefined;
         chat_input.value = '';
         chat_input.style.height = '1em';
-        ws.send('new_msg', {target: target, message: val});
+        const when = send_at.value ? new Date(send_at.value).getTime() : undefined;
+        ws.send('new_msg', {
+            target: target, group: group, message: val, reply_to: reply_to, send_at: when,
+            markdown: markdown_switch.checked || undefined,
+        });
+        set_reply();
+        send_at.value = '';
+        send_at.hidden = true;
+    });
+
+    document.getElementById('chat-file').addEventListener('change', function () {
+        const current = current_target();
+        const file = this.files[0];
+        this.value = '';
+        if (!current || !file) return;
+
+        const form = new FormData();
+        if (current.dataset.group) form.append('group', current.dataset.group);
+        else form.append('target', current.dataset.id);
+        form.append('file', file);
+        fetch('/upload', {method: 'POST', body: form}).then(async res => {
+            if (!res.ok) create_alert(await res.text());
+        }, create_alert);
     });
 
     document.getElementById('info-btn').addEventListener('click', function () {
         ws.send('meta');
     });
 
-    document.getElementById('add-btn').addEventListener('click', function () {
+    const add_btn = document.getElementById('add-btn');
+    add_btn.addEventListener('click', function () {
+        save_draft();
+        chat_input.value = '';
+        resize_input();
         current_target()?.classList.remove('active');
         chat.style.removeProperty('display');
         chat_title.innerHTML = '<input type="text" class="form-control" placeholder="Address&hellip;">';
         history.innerHTML = '';
+        update_actions();
+    });
+
+    // open_chat opens the conversation with an address, or starts a new one
+    function open_chat(addr) {
+        const ele = contact_list.querySelector(`button.list-group-item[data-addr="${addr}"]`);
+        if (ele) return ele.click();
+        add_btn.click();
+        chat_title.firstChild.value = addr;
+        chat_input.focus();
+    }
+
+    // add_contact adds the contact of a shared address, after asking, or opens the conversation if it is known
+    function add_contact(addr, name) {
+        const ele = contact_list.querySelector(`button.list-group-item[data-addr="${addr}"]`);
+        if (ele) return ele.click();
+        if (confirm(`Add ${name ? `${name} (${addr})` : addr} to your contacts?`))
+            ws.send('add_contact', {addr, name: name || undefined});
+    }
+
+    ws.register('contact_added', function (id) {
+        find_contact(id)?.click();
+    });
+
+    // address links (/add?addr=...) are redirected here
+    const link = new URLSearchParams(location.hash.slice(1));
+    if (link.has('add')) {
+        window.history.replaceState(null, '', location.pathname + location.search);
+        ws.opened(() => add_contact(link.get('add'), link.get('name')));
+    }
+
+    document.getElementById('protocol-btn').addEventListener('click', function () {
+        navigator.registerProtocolHandler('web+nymo', `${location.origin}/add?addr=%s`);
+    });
+
+    share_btn.addEventListener('click', function () {
+        const current = current_target();
+        if (!current) return;
+        share_contact.innerHTML = '';
+        for (const btn of contact_list.querySelectorAll('button.list-group-item[data-id][data-state="0"]')) {
+            if (btn === current) continue;
+            const option = document.createElement('option');
+            option.value = btn.dataset.id;
+            option.innerText = btn.dataset.alias ? `${btn.dataset.alias} (${btn.dataset.addr})` : btn.dataset.addr;
+            share_contact.append(option);
+        }
+        if (!share_contact.options.length) return create_alert('No other contact to share.');
+        share_modal.show();
+    });
+
+    document.getElementById('share-send').addEventListener('click', function () {
+        const current = current_target();
+        if (!current || !share_contact.value) return;
+        const conv = conv_of(current);
+        ws.send('share_contact', {...(typeof conv === 'object' ? conv : {target: conv}), contact: parseInt(share_contact.value)});
+        share_modal.hide();
+    });
+
+    for (const action of contact_actions.children) {
+        action.addEventListener('click', function () {
+            const current = current_target();
+            if (!current) return;
+            ws.send('state', {
+                id: parseInt(current.dataset.id),
+                state: parseInt(this.dataset.state),
+            });
+        });
+    }
+
+    receipts_switch.addEventListener('change', function () {
+        const current = current_target();
+        if (!current) return;
+        ws.send('receipts', {id: parseInt(current.dataset.id), enabled: this.checked});
+    });
+
+    ws.register('receipts', function ({id, enabled}) {
+        const ele = find_contact(id);
+        if (!ele) return;
+
+        ele.dataset.receipts = enabled;
+        if (ele.classList.contains('active'))
+            receipts_switch.checked = enabled;
+    });
+
+    function update_expiry(btn) {
+        const expire = btn.dataset.expire ?? '0';
+        if (!expiry_select.querySelector(`option[value="${expire}"]`)) {
+            const option = document.createElement('option');
+            option.value = expire;
+            option.innerText = `Disappear after ${expire} seconds`;
+            expiry_select.append(option);
+        }
+        expiry_select.value = expire;
+    }
+
+    expiry_select.addEventListener('change', function () {
+        const current = current_target();
+        if (!current) return;
+        const conv = conv_of(current);
+        const expire = parseInt(this.value);
+        ws.send('expiry', typeof conv === 'object' ? {...conv, expire} : {target: conv, expire});
+    });
+
+    ws.register('expiry', function ({target, group, expire}) {
+        const ele = find_conv({target, group});
+        if (!ele) return;
+
+        ele.dataset.expire = expire;
+        if (ele.classList.contains('active'))
+            update_expiry(ele);
+    });
+
+    ws.register('msg_deleted', function ({target, group, ids}) {
+        refresh_scheduled();
+        if (!find_conv({target, group})?.classList.contains('active')) return;
+        for (const id of ids) {
+            if (reply_to === id) set_reply();
+            history.querySelector(`div[data-id="${id}"]`)?.remove();
+        }
+    });
+
+    // msg_of returns the reference to a message of the current conversation as sent to the server
+    function msg_of(id) {
+        const conv = conv_of(current_target());
+        return typeof conv === 'object' ? {...conv, id: id} : {target: conv, id: id};
+    }
+
+    document.getElementById('delete-msg').addEventListener('click', function () {
+        if (!current_target() || !reply_to) return;
+        ws.send('delete_msg', msg_of(reply_to));
+    });
+
+    for (const b of document.getElementById('react-bar').children) {
+        b.addEventListener('click', function () {
+            if (!current_target() || !reply_to) return;
+            ws.send('react', {...msg_of(reply_to), reaction: b.dataset.emoji});
+            set_reply();
+        });
+    }
+
+    ws.register('reaction', function ({target, group, id, content}) {
+        if (!find_conv({target, group})?.classList.contains('active')) return;
+        history.querySelector(`div[data-id="${id}"]`)?.replaceWith(htmlToElement(content));
+    });
+
+    edit_msg.addEventListener('click', function () {
+        const msg = history.querySelector(`div[data-id="${reply_to}"]`);
+        if (!current_target() || !msg) return;
+        editing_msg = reply_to;
+        edit_text.value = msg.dataset.text;
+        edit_markdown.checked = 'markdown' in msg.dataset;
+        edit_modal.show();
+    });
+
+    document.getElementById('edit-save').addEventListener('click', function () {
+        if (!current_target() || !editing_msg) return;
+        ws.send('edit_msg', {...msg_of(editing_msg), message: edit_text.value, markdown: edit_markdown.checked || undefined});
+        edit_modal.hide();
+        set_reply();
+    });
+
+    retract_msg.addEventListener('click', function () {
+        if (!current_target() || !reply_to || !confirm('Retract this message? Its content is removed for everyone.')) return;
+        ws.send('retract_msg', msg_of(reply_to));
+        set_reply();
+    });
+
+    ws.register('msg_edited', function ({target, group, id, content}) {
+        if (!find_conv({target, group})?.classList.contains('active')) return;
+        if (reply_to === id) set_reply();
+        history.querySelector(`div[data-id="${id}"]`)?.replaceWith(htmlToElement(content));
+    });
+
+    const trace_modal = new bootstrap.Modal(document.getElementById('trace-modal'));
+    const trace_copies = document.getElementById('trace-copies');
+
+    ws.register('trace', function ({id, seen_by, copies}) {
+        const link = history.querySelector(`a[data-trace="${id}"]`);
+        if (link) link.textContent = `\u{1F441}\uFE0E ${seen_by}`;
+
+        trace_copies.innerHTML = '';
+        for (const c of copies) {
+            const head = document.createElement('h6');
+            head.className = 'text-truncate';
+            head.innerText = `${c.hash.slice(0, 16)}\u2026 (cohort ${c.cohort}${c.deleted ? ', no longer relayed' : ''})`;
+            head.title = c.hash;
+            const list = document.createElement('ul');
+            list.className = 'list-group mb-3';
+            for (const p of c.peers) {
+                const li = document.createElement('li');
+                li.className = 'list-group-item d-flex justify-content-between align-items-center';
+                li.innerText = p.url ?? p.id;
+                li.title = p.id;
+                if (p.connected)
+                    li.insertAdjacentHTML('beforeend', '<span class="badge bg-success">Connected</span>');
+                list.append(li);
+            }
+            if (!c.peers.length)
+                list.insertAdjacentHTML('beforeend', '<li class="list-group-item text-muted">No peer is known to have it yet.</li>');
+            trace_copies.append(head, list);
+        }
+        if (!copies.length)
+            trace_copies.innerHTML = '<p class="text-muted mb-0">The message is not traced.</p>';
+        trace_modal.show();
+    });
+
+    ws.register('edits', function ({versions}) {
+        versions_list.innerHTML = '';
+        for (const v of versions ?? []) {
+            const li = document.createElement('li');
+            li.className = 'list-group-item';
+            const time = document.createElement('div');
+            time.className = 'small text-muted';
+            time.innerText = format_time(v.time);
+            const text = document.createElement('div');
+            text.className = 'text-break';
+            text.style.whiteSpace = 'pre-wrap';
+            text.innerText = v.content;
+            li.append(time, text);
+            versions_list.prepend(li);
+        }
+        versions_modal.show();
+    });
+
+    document.getElementById('clear-btn').addEventListener('click', function () {
+        const current = current_target();
+        if (!current || !confirm('Delete all messages of this conversation?')) return;
+        ws.send('clear', conv_of(current));
+    });
+
+    delete_btn.addEventListener('click', function () {
+        const current = current_target();
+        if (!current || current.dataset.group) return;
+        const id = parseInt(current.dataset.id);
+        // the messages of a contact are deleted along with it, the ones it wrote in groups included
+        const groups = [...contact_list.querySelectorAll('button.list-group-item[data-group]')]
+            .filter(btn => member_ids(btn).includes(id)).length;
+        const warning = groups ? `\n\nThis contact is a member of ${groups} group(s). The messages it wrote there are deleted as well.`
+            : '\n\nMessages it wrote in groups are deleted as well.';
+        if (!confirm('Delete this contact and its messages?' + warning)) return;
+        ws.send('delete_contact', id);
+    });
+
+    verify_btn.addEventListener('click', function () {
+        const current = current_target();
+        if (!current || current.dataset.group) return;
+        ws.send('fingerprint', parseInt(current.dataset.id));
+    });
+
+    ws.register('fingerprint', function ({id, fingerprint}) {
+        const ele = find_contact(id);
+        if (!ele?.classList.contains('active')) return;
+
+        fingerprint_text.innerText = fingerprint;
+        fingerprint_qr.src = `/qr?contact=${id}`;
+        verified_switch.checked = !!ele.dataset.verified;
+        verify_modal.show();
+    });
+
+    verified_switch.addEventListener('change', function () {
+        const current = current_target();
+        if (!current || current.dataset.group) return;
+        ws.send('verify', {id: parseInt(current.dataset.id), verified: this.checked});
+    });
+
+    ws.register('verified', function ({id, verified}) {
+        const ele = find_contact(id);
+        if (!ele) return;
+
+        if (verified) ele.dataset.verified = 'true';
+        else delete ele.dataset.verified;
+        update_name(ele);
+    });
+
+    function format_time(ms) {
+        return ms ? new Date(parseInt(ms)).toLocaleString() : 'Never';
+    }
+
+    details_btn.addEventListener('click', function () {
+        const current = current_target();
+        if (!current || current.dataset.group) return;
+        details_avatar.hidden = !current.dataset.avatar;
+        details_avatar.src = current.dataset.avatar ? `/avatar?id=${current.dataset.id}&v=${current.dataset.avatar}` : '';
+        document.getElementById('details-created').innerText = format_time(current.dataset.created);
+        document.getElementById('details-last-seen').innerText = format_time(current.dataset.lastSeen);
+        details_tags.value = tags_of(current).join(', ');
+        details_note.value = current.dataset.note ?? '';
+        details_modal.show();
+    });
+
+    document.getElementById('details-save').addEventListener('click', function () {
+        const current = current_target();
+        if (!current || current.dataset.group) return;
+        const id = parseInt(current.dataset.id);
+        const note = details_note.value.trim();
+        if (note !== (current.dataset.note ?? ''))
+            ws.send('note', {id, note: note || undefined});
+        const tags = details_tags.value.split(',').map(t => t.trim()).filter(t => t);
+        if (tags.join(',') !== tags_of(current).join(','))
+            ws.send('tags', {id, tags});
+        details_modal.hide();
+    });
+
+    function avatar_request(method, body) {
+        const current = current_target();
+        if (!current || current.dataset.group) return;
+        fetch(`/avatar?id=${current.dataset.id}`, {method, body}).then(async res => {
+            if (!res.ok) create_alert(await res.text());
+        }, create_alert);
+    }
+
+    document.getElementById('details-avatar-file').addEventListener('change', function () {
+        const file = this.files[0];
+        this.value = '';
+        if (!file) return;
+        const form = new FormData();
+        form.append('file', file);
+        avatar_request('POST', form);
+    });
+
+    document.getElementById('details-avatar-remove').addEventListener('click', () => avatar_request('DELETE'));
+
+    ws.register('note', function ({id, note}) {
+        const ele = find_contact(id);
+        if (!ele) return;
+
+        if (note) ele.dataset.note = note;
+        else delete ele.dataset.note;
+    });
+
+    ws.register('tags', function ({id, tags}) {
+        const ele = find_contact(id);
+        if (!ele) return;
+
+        if (tags?.length) ele.dataset.tags = tags.join(',');
+        else delete ele.dataset.tags;
+        update_name(ele);
+        update_tag_filter();
+    });
+
+    ws.register('avatar', function ({id, avatar}) {
+        const ele = find_contact(id);
+        if (!ele) return;
+
+        if (avatar) ele.dataset.avatar = Date.now();
+        else delete ele.dataset.avatar;
+        update_name(ele);
+        if (ele.classList.contains('active')) {
+            details_avatar.hidden = !avatar;
+            details_avatar.src = avatar ? `/avatar?id=${id}&v=${ele.dataset.avatar}` : '';
+        }
+    });
+
+    function update_notify_btn() {
+        notify_btn.hidden = !('Notification' in window) || Notification.permission !== 'default';
+    }
+
+    notify_btn.addEventListener('click', () => Notification.requestPermission().then(update_notify_btn));
+
+    previews_switch.addEventListener('change', function () {
+        ws.send('previews', {previews: this.checked});
+    });
+
+    ws.register('previews', ({previews}) => previews_switch.checked = previews);
+
+    sync_switch.addEventListener('change', function () {
+        ws.send('sync', {sync: this.checked});
+    });
+
+    ws.register('sync', ({sync}) => sync_switch.checked = sync);
+
+    ws.register('notify', function ({target, group, title, body}) {
+        if (!document.hidden || !('Notification' in window) || Notification.permission !== 'granted') return;
+        // the tag makes further messages of the same conversation replace the notification
+        const notification = new Notification(title, {body, tag: group ? `group-${group}` : `contact-${target}`});
+        notification.addEventListener('click', function () {
+            window.focus();
+            const ele = find_conv({target, group});
+            if (ele && !ele.classList.contains('active')) ele.click();
+            this.close();
+        });
+    });
+
+    document.getElementById('rules-btn').addEventListener('click', function () {
+        modal_comp.hide();
+        ws.send('rules', null);
+        rules_modal.show();
+    });
+
+    const stats_modal = new bootstrap.Modal(document.getElementById('stats-modal'));
+
+    function format_size(size) {
+        const units = ['B', 'KiB', 'MiB', 'GiB'];
+        let i = 0;
+        for (; size >= 1024 && i < units.length - 1; i++) size /= 1024;
+        return `${i ? size.toFixed(1) : size} ${units[i]}`;
+    }
+
+    function format_latency(ms) {
+        if (ms === undefined) return '-';
+        return ms < 1000 ? `${ms} ms` : ms < 60000 ? `${(ms / 1000).toFixed(1)} s` : `${Math.round(ms / 60000)} min`;
+    }
+
+    // table_row appends a row of cells to a table body, aligning the cells from start on to the end
+    function table_row(tbody, cells, start = 1) {
+        const tr = document.createElement('tr');
+        cells.forEach((text, i) => {
+            const td = document.createElement('td');
+            td.innerText = text;
+            td.className = i >= start ? 'text-end' : 'text-truncate';
+            tr.append(td);
+        });
+        tbody.append(tr);
+        return tr;
+    }
+
+    // stats_chart draws a bar for each of the counts, labelled with the titles
+    function stats_chart(ele, counts, titles) {
+        const max = Math.max(1, ...counts.map(c => c.sent + c.received));
+        ele.innerHTML = '';
+        counts.forEach((c, i) => {
+            const col = document.createElement('div');
+            col.title = `${titles[i]}: ${c.sent} sent, ${c.received} received`;
+            for (const [n, cls] of [[c.sent, 'bg-primary'], [c.received, 'bg-info']]) {
+                const bar = document.createElement('div');
+                bar.className = cls;
+                bar.style.height = `${n / max * 100}%`;
+                col.append(bar);
+            }
+            ele.append(col);
+        });
+    }
+
+    document.getElementById('stats-btn').addEventListener('click', function () {
+        modal_comp.hide();
+        fetch('/stats').then(async res => {
+            if (!res.ok) return create_alert(await res.text());
+            const stats = await res.json();
+
+            const totals = document.getElementById('stats-totals');
+            totals.querySelector('[data-stat="sent"]').innerText = stats.sent;
+            totals.querySelector('[data-stat="received"]').innerText = stats.received;
+            totals.querySelector('[data-stat="latency"]').innerText = format_latency(stats.latency);
+            totals.querySelector('[data-stat="storage"]').innerText = format_size(stats.storage);
+
+            const convs = document.getElementById('stats-convs');
+            convs.innerHTML = '';
+            for (const c of stats.conversations)
+                table_row(convs, [c.name, c.sent, c.received, format_latency(c.latency), format_size(c.storage),
+                    c.last_active ? format_time(c.last_active) : '-']);
+
+            // fill in the days without messages
+            const days = [], titles = [];
+            const by_day = Object.fromEntries(stats.days.map(d => [d.day, d]));
+            for (let i = 29; i >= 0; i--) {
+                const d = new Date();
+                d.setDate(d.getDate() - i);
+                const day = `${d.getFullYear()}-${String(d.getMonth() + 1).padStart(2, '0')}-${String(d.getDate()).padStart(2, '0')}`;
+                days.push(by_day[day] ?? {sent: 0, received: 0});
+                titles.push(day);
+            }
+            stats_chart(document.getElementById('stats-days'), days, titles);
+            stats_chart(document.getElementById('stats-hours'), stats.hours, stats.hours.map((_, h) => `${h}:00`));
+            stats_modal.show();
+        }, create_alert);
+    });
+
+    const network_modal = new bootstrap.Modal(document.getElementById('network-modal'));
+
+    document.getElementById('network-btn').addEventListener('click', function () {
+        modal_comp.hide();
+        fetch('/network').then(async res => {
+            if (!res.ok) return create_alert(await res.text());
+            const stats = await res.json();
+
+            const totals = document.getElementById('network-totals');
+            for (const ele of totals.querySelectorAll('[data-stat]'))
+                ele.innerText = stats[ele.dataset.stat];
+
+            const peers = document.getElementById('network-peers');
+            peers.innerHTML = '';
+            for (const p of stats.peers) {
+                const tr = table_row(peers, [p.url ?? p.id, p.connected ? 'Connected' : format_time(p.last_seen),
+                    p.offered, p.fetched, p.listed, `${p.overlap} / ${p.known}`, `${p.gossiped} (${p.urls})`, p.penalize], 2);
+                tr.firstChild.title = p.id;
+                if (p.connected) tr.classList.add('table-success');
+            }
+
+            const cohorts = document.getElementById('network-cohorts');
+            cohorts.innerHTML = '';
+            for (const c of stats.cohorts)
+                table_row(cohorts, [c.cohort, c.stored, c.known, c.peer_urls]);
+            network_modal.show();
+        }, create_alert);
+    });
+
+    document.getElementById('rule-add').addEventListener('click', function () {
+        const inputs = ['sender', 'content', 'reply'].map(k => document.getElementById('rule-' + k));
+        const [sender, content, reply] = inputs.map(i => i.value.trim());
+        if (!reply) return;
+        ws.send('rule_set', {sender, content, reply, enabled: true});
+        inputs.forEach(i => i.value = '');
+    });
+
+    ws.register('rules', function (rules) {
+        rules_list.innerHTML = '';
+        for (const rule of rules ?? []) {
+            const li = document.createElement('li');
+            li.className = 'list-group-item d-flex align-items-center';
+            const text = document.createElement('div');
+            text.className = 'flex-fill text-truncate small';
+            text.innerText = `${rule.sender || 'Anyone'}: ${rule.content ? `/${rule.content}/` : 'any message'} \u2192 ${rule.reply}`;
+            li.append(text);
+            if (!rule.id) {
+                li.insertAdjacentHTML('beforeend', '<span class="badge bg-secondary" title="Set in config.toml">config</span>');
+            } else {
+                const toggle = document.createElement('input');
+                toggle.type = 'checkbox';
+                toggle.className = 'form-check-input mx-2';
+                toggle.title = 'Enabled';
+                toggle.checked = rule.enabled;
+                toggle.addEventListener('change', () => ws.send('rule_set', {...rule, enabled: toggle.checked}));
+                const del = document.createElement('button');
+                del.type = 'button';
+                del.className = 'btn btn-sm btn-outline-danger';
+                del.innerText = 'Delete';
+                del.addEventListener('click', () => ws.send('rule_delete', rule.id));
+                li.append(toggle, del);
+            }
+            rules_list.append(li);
+        }
+    });
+
+    // local_input formats a time for datetime-local inputs
+    function local_input(ms) {
+        const d = new Date(ms);
+        d.setMinutes(d.getMinutes() - d.getTimezoneOffset());
+        return d.toISOString().slice(0, 16);
+    }
+
+    document.getElementById('schedule-btn').addEventListener('click', function () {
+        send_at.hidden = !send_at.hidden;
+        send_at.value = send_at.hidden ? '' : local_input(Date.now() + 3600 * 1000);
+    });
+
+    document.getElementById('scheduled-btn').addEventListener('click', function () {
+        ws.send('scheduled', null);
+        scheduled_modal.show();
+    });
+
+    ws.register('scheduled', function (list) {
+        scheduled_list.innerHTML = '';
+        document.getElementById('scheduled-empty').hidden = !!list?.length;
+        for (const msg of list ?? []) {
+            const li = document.createElement('li');
+            li.className = 'list-group-item';
+            const name = document.createElement('div');
+            name.className = 'small text-muted mb-1';
+            name.innerText = msg.name;
+            const row = document.createElement('div');
+            row.className = 'd-flex';
+            const text = document.createElement('input');
+            text.className = 'form-control form-control-sm me-2';
+            text.value = msg.message;
+            const when = document.createElement('input');
+            when.type = 'datetime-local';
+            when.className = 'form-control form-control-sm w-auto me-2';
+            when.value = local_input(msg.send_at);
+            const save = document.createElement('button');
+            save.type = 'button';
+            save.className = 'btn btn-sm btn-outline-primary me-2';
+            save.innerText = 'Save';
+            save.addEventListener('click', () => ws.send('schedule_edit', {
+                id: msg.id, message: text.value, send_at: new Date(when.value).getTime(),
+            }));
+            const cancel = document.createElement('button');
+            cancel.type = 'button';
+            cancel.className = 'btn btn-sm btn-outline-danger';
+            cancel.innerText = 'Cancel';
+            cancel.addEventListener('click', () => ws.send('delete_msg', {target: msg.target, group: msg.group, id: msg.id}));
+            row.append(text, when, save, cancel);
+            li.append(name, row);
+            scheduled_list.append(li);
+        }
+    });
+
+    // refresh_scheduled updates the list of scheduled messages if it is shown
+    function refresh_scheduled() {
+        if (scheduled_modal_ele.classList.contains('show')) ws.send('scheduled', null);
+    }
+
+    ws.register('msg_scheduled', function ({target, group, id, content}) {
+        refresh_scheduled();
+        if (!find_conv({target, group})?.classList.contains('active')) return;
+        history.querySelector(`div.justify-content-end[data-id="${id}"]`)?.replaceWith(htmlToElement(content));
+    });
+
+    ws.register('cleared', function ({target, group}) {
+        const ele = find_conv({target, group});
+        if (!ele) return;
+
+        delete ele.dataset.message;
+        update_name(ele);
+        if (ele.classList.contains('active')) {
+            history.innerHTML = '';
+            set_reply();
+        }
+    });
+
+    ws.register('contact_deleted', function (id) {
+        const ele = find_contact(id);
+        if (!ele) return;
+
+        if (ele.classList.contains('active')) {
+            chat.style.display = 'none';
+            set_reply();
+        }
+        ele.remove();
+        for (const l of [requests, blocked, archived])
+            l.parentElement.hidden = !l.childElementCount;
+    });
+
+    ws.register('receipt', function ({target, ids, status}) {
+        if (current_target()?.dataset.id != target) return;
+        for (const id of ids) {
+            const receipt = history.querySelector(`div[data-id="${id}"] small.receipt`);
+            if (receipt) receipt.dataset.receipt = status;
+        }
+    });
+
+    document.addEventListener('visibilitychange', function () {
+        const current = current_target();
+        if (!document.hidden && current) ws.send('read', conv_of(current));
+    });
+
+    ws.register('state', function ({id, state}) {
+        const ele = find_contact(id);
+        if (!ele) return;
+
+        ele.dataset.state = state;
+        place_contact(ele);
+        if (ele.classList.contains('active'))
+            update_actions(ele);
     });
 
     ws.register('alias', function (data) {
-        const ele = contacts.querySelector(`button.list-group-item[data-id="${data.id}"]`);
+        const ele = find_contact(data.id);
         if (!ele) return;
 
         if (!data.name) delete ele.dataset.alias;
@@ -200,6 +1213,7 @@ ${content}<button type="button" class="btn-close" data-bs-dismiss="alert" aria-l
     chat_title.addEventListener('click', function () {
         const current = current_target();
         if (!current || this.firstChild.tagName === 'INPUT') return;
+        if (current.dataset.group) return open_group(current);
         const input = document.createElement('input');
         input.type = 'text';
         input.className = 'form-control';
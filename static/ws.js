@@ -20,3 +20,9 @@ export function send(command, data) {
 export function register(command, handle) {
     handles[command] = handle;
 }
+
+// opened runs f once the connection is open.
+export function opened(f) {
+    if (ws.readyState === WebSocket.OPEN) f();
+    else ws.addEventListener('open', f, {once: true});
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nymo-net/nymo"
+)
+
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 366
+)
+
+// msgCount counts the messages sent and received.
+type msgCount struct {
+	Sent     int `json:"sent"`
+	Received int `json:"received"`
+}
+
+// convStats is the activity of a conversation. Latency is the average delay (in milliseconds) between sending and
+// receiving the received messages, and Storage the bytes taken by its messages and files.
+type convStats struct {
+	conversation
+	Name string `json:"name"`
+	msgCount
+	Latency    *int64 `json:"latency,omitempty"`
+	Storage    int64  `json:"storage"`
+	LastActive *int64 `json:"last_active,omitempty"`
+}
+
+type dayStats struct {
+	Day string `json:"day"`
+	msgCount
+}
+
+// usageStats aggregates the stored messages. Days lists the recent days with any message, and Hours the hours of
+// the day (in the server's time zone) messages were sent at.
+type usageStats struct {
+	msgCount
+	Latency       *int64       `json:"latency,omitempty"`
+	Storage       int64        `json:"storage"`
+	Conversations []convStats  `json:"conversations"`
+	Days          []dayStats   `json:"days"`
+	Hours         [24]msgCount `json:"hours"`
+}
+
+// msgStats selects the counts, latency and storage of the dec_msg rows (aliased `d`, joined with their attachments
+// as `a`) of a group.
+const msgStats = "IFNULL(SUM(`d`.`self` AND `d`.`send_time` IS NOT NULL), 0), IFNULL(SUM(NOT `d`.`self`), 0), " +
+	"CAST(AVG(CASE WHEN NOT `d`.`self` THEN MAX(`d`.`recv_time`-`d`.`send_time`, 0) END) AS INTEGER), " +
+	"IFNULL(SUM(LENGTH(CAST(`d`.`content` AS BLOB)) + IFNULL(`a`.`size`, 0)), 0)"
+
+func (db *database) getStats(days int) (*usageStats, error) {
+	ret := &usageStats{Conversations: make([]convStats, 0), Days: make([]dayStats, 0)}
+
+	err := db.QueryRow("SELECT "+msgStats+" FROM `dec_msg` `d` LEFT JOIN `attachment` `a` ON `a`.`msg`=`d`.ROWID").
+		Scan(&ret.Sent, &ret.Received, &ret.Latency, &ret.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	// group rows are counted per group, see conversation.where
+	query, err := db.Query("SELECT `s`.*, `u`.`key`, `u`.`alias`, IFNULL(`g`.`name`, 'Group') FROM (SELECT " +
+		"CASE WHEN `d`.`group` IS NULL THEN `d`.`target` ELSE 0 END AS `conv_target`, IFNULL(`d`.`group`, 0) AS `conv_group`, " +
+		msgStats + ", MAX(`d`.`send_time`) AS `last_active`, COUNT(*) AS `total` " +
+		"FROM `dec_msg` `d` LEFT JOIN `attachment` `a` ON `a`.`msg`=`d`.ROWID GROUP BY `conv_target`, `conv_group`) `s` " +
+		"LEFT JOIN `user` `u` ON `u`.`rowid`=`s`.`conv_target` AND `s`.`conv_group`=0 LEFT JOIN `group` `g` ON `g`.`rowid`=`s`.`conv_group` " +
+		"ORDER BY `s`.`total` DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+
+	for query.Next() {
+		var c convStats
+		var key []byte
+		var alias *string
+		var group string
+		var total int
+		err = query.Scan(&c.Target, &c.Group, &c.Sent, &c.Received, &c.Latency, &c.Storage, &c.LastActive, &total, &key, &alias, &group)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case c.Group > 0:
+			c.Name = group
+		case alias != nil && *alias != "":
+			c.Name = *alias
+		default:
+			c.Name = nymo.ConvertAddrToStr(key)
+		}
+		ret.Conversations = append(ret.Conversations, c)
+	}
+	if err = query.Err(); err != nil {
+		return nil, err
+	}
+
+	since := time.Now().AddDate(0, 0, 1-days)
+	since = time.Date(since.Year(), since.Month(), since.Day(), 0, 0, 0, 0, time.Local)
+	query, err = db.Query("SELECT DATE(`send_time`/1000, 'unixepoch', 'localtime') AS `day`, SUM(`self`), SUM(NOT `self`) "+
+		"FROM `dec_msg` WHERE `send_time`>=? GROUP BY `day` ORDER BY `day`", since.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+
+	for query.Next() {
+		var d dayStats
+		if err = query.Scan(&d.Day, &d.Sent, &d.Received); err != nil {
+			return nil, err
+		}
+		ret.Days = append(ret.Days, d)
+	}
+	if err = query.Err(); err != nil {
+		return nil, err
+	}
+
+	query, err = db.Query("SELECT CAST(STRFTIME('%H', `send_time`/1000, 'unixepoch', 'localtime') AS INTEGER) AS `hour`, " +
+		"SUM(`self`), SUM(NOT `self`) FROM `dec_msg` WHERE `send_time` IS NOT NULL GROUP BY `hour`")
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+
+	for query.Next() {
+		var hour int
+		var c msgCount
+		if err = query.Scan(&hour, &c.Sent, &c.Received); err != nil {
+			return nil, err
+		}
+		if hour >= 0 && hour < len(ret.Hours) {
+			ret.Hours[hour] = c
+		}
+	}
+	return ret, query.Err()
+}
+
+// serveStats returns the usage statistics, including the activity of the last days (?days=, 30 by default).
+func (w *webui) serveStats(wr http.ResponseWriter, r *http.Request) {
+	days := defaultStatsDays
+	if d := r.URL.Query().Get("days"); d != "" {
+		var err error
+		if days, err = strconv.Atoi(d); err != nil || days <= 0 || days > maxStatsDays {
+			http.Error(wr, "invalid days", http.StatusBadRequest)
+			return
+		}
+	}
+
+	stats, err := w.db.getStats(days)
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(wr).Encode(stats)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nymo-net/nymo"
+)
+
+// syncInfo is carried by the envelopes a device sends to the other devices sharing its identity. It is about the
+// conversation with Peer, or the group of the envelope.
+type syncInfo struct {
+	Peer []byte `json:"peer,omitempty"`
+	// Message is a copy of a message we sent.
+	Message *envelope `json:"message,omitempty"`
+	// ReadUntil marks the received messages sent until then (unix milliseconds) as read.
+	ReadUntil int64 `json:"read_until,omitempty"`
+}
+
+type setSync struct {
+	Sync bool `json:"sync"`
+}
+
+// exportKey writes the identity key to a file, for another device to be linked with -import-key.
+func exportKey(path string) error {
+	db, err := openDatabase(config.Database)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	key, err := db.getUserKey()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600)
+}
+
+// importKey reads an identity key written by exportKey.
+func importKey(path string) ([]byte, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) <= 0 || len(key) > 32 || len(bytes.Trim(key, "\x00")) <= 0 {
+		return nil, errors.New("invalid identity key")
+	}
+	return key, nil
+}
+
+func (db *database) getSync() (sync bool, err error) {
+	err = db.QueryRow("SELECT `sync` FROM `user` WHERE `rowid`=0").Scan(&sync)
+	return
+}
+
+func (w *webui) setSync(msg json.RawMessage) error {
+	var nm setSync
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+
+	_, err := w.db.Exec("UPDATE `user` SET `sync`=? WHERE `rowid`=0", nm.Sync)
+	if err != nil {
+		return err
+	}
+
+	go w.broadcast("sync", nm)
+	return nil
+}
+
+// sendSync sends the information about a conversation to our other devices, if syncing is enabled. The sent message
+// is recorded as authored by the dec_msg row (if any), see sendPayload.
+func (w *webui) sendSync(conv conversation, info *syncInfo, row int64) error {
+	enabled, err := w.db.getSync()
+	if err != nil || !enabled {
+		return err
+	}
+
+	env, err := newEnvelope(envelopeSync)
+	if err != nil {
+		return err
+	}
+	env.Sync = info
+	if conv.Group > 0 {
+		env.Group, _, err = w.db.getGroup(conv.Group)
+	} else {
+		err = w.db.QueryRow("SELECT `key` FROM `user` WHERE `rowid`=?", conv.Target).Scan(&info.Peer)
+	}
+	if err != nil {
+		return err
+	}
+
+	payload, err := env.marshal()
+	if err != nil {
+		return err
+	}
+	return w.sendPayload(w.user.Address(), payload, row)
+}
+
+// syncSent copies a text message we sent to our other devices. Files are not copied, as they would be sent again
+// in full.
+func (w *webui) syncSent(conv conversation, id int64) error {
+	m := &envelope{Type: envelopeText}
+	err := w.db.QueryRow("SELECT `version`, `msg_id`, `content_type`, `content`, `reply_to`, `expire` FROM `dec_msg` "+
+		"WHERE ROWID=? AND `msg_id` IS NOT NULL AND ROWID NOT IN (SELECT `msg` FROM `attachment` WHERE `msg` IS NOT NULL)", id).
+		Scan(&m.Version, &m.Id, &m.ContentType, &m.Text, &m.ReplyTo, &m.Expire)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return w.sendSync(conv, &syncInfo{Message: m}, id)
+}
+
+// syncRead tells our other devices that the received messages of a conversation sent until then were read.
+func (w *webui) syncRead(conv conversation, until int64) {
+	if err := w.sendSync(conv, &syncInfo{ReadUntil: until}, 0); err != nil {
+		log.Warnf("[webui] syncing read marker: %s", err)
+	}
+}
+
+// syncGroup returns the group of a synced envelope, joining it if it is unknown.
+func (db *database) syncGroup(info *groupInfo) (uint, error) {
+	var group uint
+	err := db.QueryRow("SELECT `rowid` FROM `group` WHERE `group_id`=?", info.Id).Scan(&group)
+	if err == sql.ErrNoRows {
+		return db.resolveGroup(0, web.user.Address().Bytes(), info)
+	}
+	return group, err
+}
+
+// storeSync applies an envelope from another device sharing our identity.
+func (db *database) storeSync(env *envelope, sendTime time.Time) error {
+	if env.Type != envelopeSync || env.Sync == nil {
+		log.Warnf("[webui] unexpected envelope type %q from ourselves", env.Type)
+		return nil
+	}
+	enabled, err := db.getSync()
+	if err != nil || !enabled {
+		return err
+	}
+
+	var conv conversation
+	if env.Group != nil {
+		if conv.Group, err = db.syncGroup(env.Group); err != nil || conv.Group <= 0 {
+			return err
+		}
+	} else {
+		if nymo.NewAddressFromBytes(env.Sync.Peer) == nil {
+			log.Warn("[webui] invalid synced conversation")
+			return nil
+		}
+		if conv.Target, err = db.lookupUserId(env.Sync.Peer, contactAccepted); err != nil {
+			return err
+		}
+		if err = web.acceptContact(conv.Target); err != nil {
+			log.WithField("target", conv.Target).Infof("[webui] synced message dropped: %s", err)
+			return nil
+		}
+	}
+
+	if env.Sync.Message != nil {
+		return db.storeSynced(conv, env.Sync.Message, sendTime)
+	}
+	if env.Sync.ReadUntil > 0 {
+		cond, arg := conv.where("")
+		_, err = db.Exec("UPDATE `dec_msg` SET `receipt`=? WHERE "+cond+" AND NOT `self` AND `receipt`<? AND NOT `quarantine` AND `send_time`<=?",
+			receiptRead, arg, receiptRead, env.Sync.ReadUntil)
+	}
+	return err
+}
+
+// storeSynced stores a copy of a message sent from another device, unless it is known already.
+func (db *database) storeSynced(conv conversation, m *envelope, sendTime time.Time) error {
+	if m.Type != envelopeText || m.Version <= 0 || len(m.Id) != msgIdSize || m.ReplyTo != nil && len(m.ReplyTo) != msgIdSize {
+		log.Warn("[webui] invalid synced message")
+		return nil
+	}
+	if m.ContentType == "" || m.ContentType == mimeContact && cardOf(m.ContentType, m.Text) == nil {
+		m.ContentType = mimeText
+	}
+	if m.Expire > maxExpiry {
+		m.Expire = maxExpiry
+	}
+
+	var quote *quoteInfo
+	var replyRow *int64
+	if m.ReplyTo != nil {
+		var err error
+		if quote, err = db.resolveQuote(conv, m.ReplyTo); err != nil {
+			return err
+		}
+		if quote != nil {
+			replyRow = &quote.Id
+		}
+	}
+
+	exec, err := db.Exec("INSERT OR IGNORE INTO `dec_msg` (`target`,`group`,`self`,`content`,`send_time`,`msg_id`,`reply_to`,`reply_row`,`content_type`,`version`,`expire`,`expire_at`) "+
+		"VALUES (?,?,TRUE,?,?,?,?,?,?,?,?,?)",
+		conv.Target, nullId(conv.Group), m.Text, sendTime.UnixMilli(), m.Id, m.ReplyTo, replyRow, m.ContentType, m.Version,
+		m.Expire, expireAt(sendTime, m.Expire))
+	if err != nil {
+		return err
+	}
+	if affected, err := exec.RowsAffected(); err != nil || affected <= 0 {
+		// duplicated message ID
+		return err
+	}
+	id, err := exec.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	go web.broadcastOwn(conv, msgRender{
+		Id:       id,
+		Self:     true,
+		Content:  m.Text,
+		Markdown: m.ContentType == mimeMarkdown,
+		Card:     cardOf(m.ContentType, m.Text),
+		SendTime: &sendTime,
+		Quote:    quote,
+	})
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+)
+
+// seenBy selects the number of peers known to have any stored message traced for the dec_msg row (aliased `d`). A peer
+// knows a message if it offered it to us, or acknowledged us offering it (see peerHandle.AckMessages).
+const seenBy = "(SELECT COUNT(DISTINCT `k`.`peer_id`) FROM `authored` `au` JOIN `known_msg` `k` ON `k`.`msg`=`au`.`message` " +
+	"WHERE `au`.`dec_msg`=`d`.ROWID AND `au`.`trace`)"
+
+type tracePeer struct {
+	Id        string  `json:"id"`
+	Url       *string `json:"url,omitempty"`
+	Connected bool    `json:"connected"`
+}
+
+// traceCopy is a stored message sent for a message, one per receiver and file chunk.
+type traceCopy struct {
+	Hash    string      `json:"hash"`
+	Cohort  uint32      `json:"cohort"`
+	Deleted bool        `json:"deleted"`
+	Peers   []tracePeer `json:"peers"`
+}
+
+type msgTrace struct {
+	Id     int64       `json:"id"`
+	SeenBy int         `json:"seen_by"`
+	Copies []traceCopy `json:"copies"`
+}
+
+// traceMessage returns how far the stored messages of a message we sent have spread.
+func (w *webui) traceMessage(msg json.RawMessage) (*msgTrace, error) {
+	ret := &msgTrace{Copies: make([]traceCopy, 0)}
+	if err := json.Unmarshal(msg, &ret.Id); err != nil {
+		return nil, err
+	}
+
+	err := w.db.QueryRow("SELECT "+seenBy+" FROM `dec_msg` `d` WHERE `d`.ROWID=? AND `d`.`self`", ret.Id).Scan(&ret.SeenBy)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := w.db.Query("SELECT `m`.`rowid`, `m`.`hash`, `m`.`cohort`, `m`.`deleted`, `p`.`rowid`, `p`.`id`, `l`.`url` "+
+		"FROM `authored` `au` JOIN `message` `m` ON `m`.`rowid`=`au`.`message` "+
+		"LEFT JOIN `known_msg` `k` ON `k`.`msg`=`m`.`rowid` LEFT JOIN `peer` `p` ON `p`.`rowid`=`k`.`peer_id` "+
+		"LEFT JOIN `peer_link` `l` ON `l`.`url_hash`=`p`.`url_hash` "+
+		"WHERE `au`.`dec_msg`=? AND `au`.`trace` ORDER BY `m`.`rowid`, `p`.`last_seen` DESC", ret.Id)
+	if err != nil {
+		return nil, err
+	}
+	defer query.Close()
+
+	var last int64
+	for query.Next() {
+		var row int64
+		var c traceCopy
+		var hash, peerId []byte
+		var peerRow *uint
+		var url *string
+		if err = query.Scan(&row, &hash, &c.Cohort, &c.Deleted, &peerRow, &peerId, &url); err != nil {
+			return nil, err
+		}
+		if len(ret.Copies) <= 0 || row != last {
+			c.Hash = hex.EncodeToString(hash)
+			c.Peers = make([]tracePeer, 0)
+			ret.Copies = append(ret.Copies, c)
+			last = row
+		}
+		if peerRow != nil {
+			p := tracePeer{Id: hex.EncodeToString(peerId), Url: url}
+			_, p.Connected = w.peer.Load(*peerRow)
+			cur := &ret.Copies[len(ret.Copies)-1]
+			cur.Peers = append(cur.Peers, p)
+		}
+	}
+	return ret, query.Err()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	fingerprintGroups = 12
+	qrSize            = 256
+)
+
+type setVerified struct {
+	Id       uint `json:"id"`
+	Verified bool `json:"verified"`
+}
+
+type fingerprint struct {
+	Id          uint   `json:"id"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// safetyNumber derives a fingerprint of two keys, which is the same for both parties.
+// It is formatted as groups of 5 digits to be compared by reading it aloud or scanning its QR code.
+func safetyNumber(a, b []byte) string {
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	h := sha512.New()
+	h.Write(a)
+	h.Write(b)
+	sum := h.Sum(nil)
+
+	groups := make([]string, fingerprintGroups)
+	for i := range groups {
+		var buf [8]byte
+		copy(buf[3:], sum[i*5:i*5+5])
+		groups[i] = fmt.Sprintf("%05d", binary.BigEndian.Uint64(buf[:])%100000)
+	}
+	return strings.Join(groups, " ")
+}
+
+func (w *webui) contactFingerprint(id uint) (string, error) {
+	var key []byte
+	if err := w.db.QueryRow("SELECT `key` FROM `user` WHERE `rowid`=? AND `rowid`>0", id).Scan(&key); err != nil {
+		return "", err
+	}
+	return safetyNumber(w.user.Address().Bytes(), key), nil
+}
+
+func (w *webui) getFingerprint(msg json.RawMessage) (*fingerprint, error) {
+	var id uint
+	if err := json.Unmarshal(msg, &id); err != nil {
+		return nil, err
+	}
+	f, err := w.contactFingerprint(id)
+	if err != nil {
+		return nil, err
+	}
+	return &fingerprint{Id: id, Fingerprint: f}, nil
+}
+
+func (w *webui) setVerified(msg json.RawMessage) error {
+	var nm setVerified
+	if err := json.Unmarshal(msg, &nm); err != nil {
+		return err
+	}
+
+	_, err := w.db.Exec("UPDATE `user` SET `verified`=? WHERE `rowid`=? AND `rowid`>0", nm.Verified, nm.Id)
+	if err != nil {
+		return err
+	}
+
+	go w.broadcast("verified", nm)
+	return nil
+}
+
+// serveQR renders the fingerprint of a contact (with ?contact=), or our own address as QR code.
+func (w *webui) serveQR(wr http.ResponseWriter, r *http.Request) {
+	content := w.user.Address().String()
+	if c := r.URL.Query().Get("contact"); c != "" {
+		id, err := strconv.ParseUint(c, 10, 0)
+		if err != nil {
+			http.NotFound(wr, r)
+			return
+		}
+		content, err = w.contactFingerprint(uint(id))
+		if err == sql.ErrNoRows {
+			http.NotFound(wr, r)
+			return
+		}
+		if err != nil {
+			http.Error(wr, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	png, err := qrcode.Encode(content, qrcode.Medium, qrSize)
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	wr.Header().Set("Content-Type", "image/png")
+	wr.Header().Set("Cache-Control", "no-store")
+	_, _ = wr.Write(png)
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/nymo-net/nymo"
+)
+
+const (
+	webhookReceived = "received"
+	webhookSent     = "sent"
+
+	webhookPollInterval = 5 * time.Second
+	webhookTimeout      = 10 * time.Second
+	webhookBackoff      = 10 * time.Second
+	webhookMaxBackoff   = time.Hour
+	webhookBatch        = 100
+	webhookLogAge       = 30 * 24 * time.Hour
+
+	defaultWebhookAttempts = 6
+)
+
+type webhook struct {
+	url         string
+	secret      []byte
+	events      map[string]bool
+	contacts    [][]byte
+	maxAttempts uint
+}
+
+var (
+	webhooks    []webhook
+	webhookWake = make(chan struct{}, 1)
+	hookClient  = http.Client{Timeout: webhookTimeout}
+)
+
+// webhookEvent is the JSON body posted to the webhooks.
+type webhookEvent struct {
+	Event       string  `json:"event"`
+	Sender      string  `json:"sender"`
+	Receiver    string  `json:"receiver,omitempty"`
+	Alias       *string `json:"alias,omitempty"`
+	Group       *string `json:"group,omitempty"`
+	Content     string  `json:"content"`
+	ContentType string  `json:"content_type"`
+	Time        int64   `json:"time"`
+}
+
+type webhookDelivery struct {
+	Id        int64   `json:"id"`
+	Url       string  `json:"url"`
+	Event     string  `json:"event"`
+	Created   int64   `json:"created"`
+	Attempts  uint    `json:"attempts"`
+	Status    *int    `json:"status,omitempty"`
+	Error     *string `json:"error,omitempty"`
+	Delivered *int64  `json:"delivered,omitempty"`
+}
+
+func compileWebhooks() error {
+	for i, h := range config.Webhook {
+		u, err := url.Parse(h.Url)
+		if err != nil {
+			return fmt.Errorf("webhook #%d: %w", i, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("webhook #%d: unsupported url scheme %q", i, u.Scheme)
+		}
+
+		wh := webhook{url: h.Url, secret: []byte(h.Secret), events: make(map[string]bool), maxAttempts: defaultWebhookAttempts}
+		if h.MaxAttempts > 0 {
+			wh.maxAttempts = h.MaxAttempts
+		}
+		if len(h.Events) <= 0 {
+			wh.events[webhookReceived] = true
+			wh.events[webhookSent] = true
+		}
+		for _, e := range h.Events {
+			if e != webhookReceived && e != webhookSent {
+				return fmt.Errorf("webhook #%d: unknown event %q", i, e)
+			}
+			wh.events[e] = true
+		}
+		for _, c := range h.Contacts {
+			addr := nymo.NewAddress(c)
+			if addr == nil {
+				return fmt.Errorf("webhook #%d: invalid contact address", i)
+			}
+			wh.contacts = append(wh.contacts, addr.Bytes())
+		}
+		webhooks = append(webhooks, wh)
+	}
+	return nil
+}
+
+// match reports whether the hook wants the event. peer is the contact on the other side, nil for group messages
+// we sent, which only go to hooks without contact filter.
+func (h *webhook) match(event string, peer []byte) bool {
+	if !h.events[event] {
+		return false
+	}
+	if len(h.contacts) <= 0 {
+		return true
+	}
+	for _, c := range h.contacts {
+		if bytes.Equal(c, peer) {
+			return true
+		}
+	}
+	return false
+}
+
+func findWebhook(u string) *webhook {
+	for i := range webhooks {
+		if webhooks[i].url == u {
+			return &webhooks[i]
+		}
+	}
+	return nil
+}
+
+// queueWebhooks records a delivery of the event for every matching hook and wakes up the runner.
+func (db *database) queueWebhooks(ev *webhookEvent, peer []byte) error {
+	var hooks []string
+	for i := range webhooks {
+		if webhooks[i].match(ev.Event, peer) {
+			hooks = append(hooks, webhooks[i].url)
+		}
+	}
+	if len(hooks) <= 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UnixMilli()
+	for _, u := range hooks {
+		_, err = db.Exec("INSERT INTO `webhook_delivery` (`url`,`event`,`payload`,`created`,`next_attempt`) VALUES (?,?,?,?,?)",
+			u, ev.Event, payload, now, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// fillWebhookEvent sets the alias of the contact and the name of the group of a conversation, and returns the
+// address of the contact.
+func (db *database) fillWebhookEvent(ev *webhookEvent, conv conversation) ([]byte, error) {
+	var key []byte
+	if conv.Target > 0 {
+		err := db.QueryRow("SELECT `key`, `alias` FROM `user` WHERE `rowid`=?", conv.Target).Scan(&key, &ev.Alias)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if conv.Group > 0 {
+		err := db.QueryRow("SELECT IFNULL(`name`, 'Group') FROM `group` WHERE `rowid`=?", conv.Group).Scan(&ev.Group)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+func (db *database) webhookReceived(conv conversation, env *envelope, sendTime time.Time) error {
+	if len(webhooks) <= 0 {
+		return nil
+	}
+
+	ev := webhookEvent{Event: webhookReceived, Content: env.Text, ContentType: env.ContentType, Time: sendTime.UnixMilli()}
+	if env.File != nil {
+		ev.Content, ev.ContentType = env.File.Name, env.File.Mime
+	}
+	if ev.ContentType == "" {
+		ev.ContentType = "text/plain"
+	}
+	peer, err := db.fillWebhookEvent(&ev, conv)
+	if err != nil {
+		return err
+	}
+	ev.Sender = nymo.ConvertAddrToStr(peer)
+	return db.queueWebhooks(&ev, peer)
+}
+
+func (w *webui) webhookSent(conv conversation, r msgRender, sendTime time.Time) error {
+	if len(webhooks) <= 0 {
+		return nil
+	}
+
+	ev := webhookEvent{
+		Event:       webhookSent,
+		Sender:      w.user.Address().String(),
+		Content:     r.Content,
+		ContentType: "text/plain",
+		Time:        sendTime.UnixMilli(),
+	}
+	if r.Attachment != nil {
+		ev.ContentType = r.Attachment.Mime
+	}
+	peer, err := w.db.fillWebhookEvent(&ev, conv)
+	if err != nil {
+		return err
+	}
+	if peer != nil {
+		ev.Receiver = nymo.ConvertAddrToStr(peer)
+	}
+	return w.db.queueWebhooks(&ev, peer)
+}
+
+// signWebhook returns the HMAC-SHA256 of "timestamp.payload".
+func signWebhook(secret []byte, timestamp string, payload []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (h *webhook) post(ctx context.Context, id int64, event string, payload []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Nymo-Event", event)
+	req.Header.Set("X-Nymo-Delivery", strconv.FormatInt(id, 10))
+	if len(h.secret) > 0 {
+		// the signed timestamp lets receivers reject replayed requests
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Nymo-Timestamp", timestamp)
+		req.Header.Set("X-Nymo-Signature", "sha256="+hex.EncodeToString(signWebhook(h.secret, timestamp, payload)))
+	}
+
+	resp, err := hookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// backoff returns the delay before the next attempt, doubling with every failed one.
+func backoff(attempts uint) time.Duration {
+	d := webhookBackoff
+	for i := uint(1); i < attempts && d < webhookMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > webhookMaxBackoff {
+		d = webhookMaxBackoff
+	}
+	return d
+}
+
+func (db *database) deliverWebhooks(ctx context.Context) error {
+	now := time.Now()
+	_, err := db.Exec("DELETE FROM `webhook_delivery` WHERE `next_attempt` IS NULL AND `created`<?",
+		now.Add(-webhookLogAge).UnixMilli())
+	if err != nil {
+		return err
+	}
+
+	query, err := db.QueryContext(ctx, "SELECT ROWID, `url`, `event`, `payload`, `attempts` FROM `webhook_delivery` "+
+		"WHERE `next_attempt`<=? ORDER BY `next_attempt` LIMIT ?", now.UnixMilli(), webhookBatch)
+	if err != nil {
+		return err
+	}
+
+	type pending struct {
+		id       int64
+		url      string
+		event    string
+		payload  []byte
+		attempts uint
+	}
+	var due []pending
+	for query.Next() {
+		var p pending
+		if err = query.Scan(&p.id, &p.url, &p.event, &p.payload, &p.attempts); err != nil {
+			_ = query.Close()
+			return err
+		}
+		due = append(due, p)
+	}
+	if err = query.Err(); err != nil {
+		return err
+	}
+
+	for _, p := range due {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		var status int
+		h := findWebhook(p.url)
+		if h == nil {
+			err = errors.New("webhook no longer configured")
+		} else {
+			status, err = h.post(ctx, p.id, p.event, p.payload)
+		}
+		p.attempts++
+
+		var statusArg interface{}
+		if status > 0 {
+			statusArg = status
+		}
+		if err == nil {
+			_, err = db.Exec("UPDATE `webhook_delivery` SET `attempts`=?, `status`=?, `error`=NULL, `delivered`=?, `next_attempt`=NULL WHERE ROWID=?",
+				p.attempts, statusArg, time.Now().UnixMilli(), p.id)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		log.WithField("url", p.url).Warnf("[webui] webhook delivery #%d failed: %s", p.id, err)
+		var next interface{}
+		if h != nil && p.attempts < h.maxAttempts {
+			next = time.Now().Add(backoff(p.attempts)).UnixMilli()
+		}
+		_, err = db.Exec("UPDATE `webhook_delivery` SET `attempts`=?, `status`=?, `error`=?, `next_attempt`=? WHERE ROWID=?",
+			p.attempts, statusArg, err.Error(), next, p.id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runWebhooks delivers queued webhook events until ctx is done.
+func (w *webui) runWebhooks(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.db.deliverWebhooks(ctx); err != nil {
+			log.Errorf("[webui, db] delivering webhooks: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-webhookWake:
+		}
+	}
+}
+
+// serveWebhookLog lists the latest webhook deliveries as JSON.
+func (w *webui) serveWebhookLog(wr http.ResponseWriter, r *http.Request) {
+	query, err := w.db.QueryContext(r.Context(), "SELECT ROWID, `url`, `event`, `created`, `attempts`, `status`, `error`, `delivered` "+
+		"FROM `webhook_delivery` ORDER BY ROWID DESC LIMIT ?", webhookBatch)
+	if err != nil {
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer query.Close()
+
+	deliveries := make([]webhookDelivery, 0)
+	for query.Next() {
+		var d webhookDelivery
+		if err = query.Scan(&d.Id, &d.Url, &d.Event, &d.Created, &d.Attempts, &d.Status, &d.Error, &d.Delivered); err != nil {
+			http.Error(wr, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err = query.Err(); err != nil {
+		http.Error(wr, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	wr.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(wr).Encode(deliveries)
+}
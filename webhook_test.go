@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testDatabase(t *testing.T) *database {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db")+dbOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if _, err = db.Exec(schema); err != nil {
+		t.Fatal(err)
+	}
+	return &database{DB: db}
+}
+
+func useWebhooks(t *testing.T, hooks ...webhook) {
+	t.Helper()
+	old := webhooks
+	webhooks = hooks
+	t.Cleanup(func() { webhooks = old })
+}
+
+func TestWebhookPost(t *testing.T) {
+	secret := []byte("secret")
+	payload := []byte(`{"event":"received"}`)
+
+	var got http.Header
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	h := webhook{url: srv.URL, secret: secret}
+	status, err := h.post(context.Background(), 42, webhookReceived, payload)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("post: status %d, err %v", status, err)
+	}
+	if string(body) != string(payload) {
+		t.Errorf("body %q, want %q", body, payload)
+	}
+
+	timestamp := got.Get("X-Nymo-Timestamp")
+	if sec, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(sec, 0)) > time.Minute {
+		t.Errorf("timestamp %q is not the current time", timestamp)
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "." + string(payload)))
+	want := map[string]string{
+		"Content-Type":     "application/json",
+		"X-Nymo-Event":     webhookReceived,
+		"X-Nymo-Delivery":  "42",
+		"X-Nymo-Signature": "sha256=" + hex.EncodeToString(mac.Sum(nil)),
+	}
+	for k, v := range want {
+		if got.Get(k) != v {
+			t.Errorf("%s: %q, want %q", k, got.Get(k), v)
+		}
+	}
+
+	// the signature covers the timestamp
+	mac.Reset()
+	mac.Write(payload)
+	if got.Get("X-Nymo-Signature") == "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Error("signature of the body alone")
+	}
+
+	h.secret = nil
+	if _, err = h.post(context.Background(), 1, webhookReceived, payload); err != nil {
+		t.Fatal(err)
+	}
+	if got.Get("X-Nymo-Signature") != "" || got.Get("X-Nymo-Timestamp") != "" {
+		t.Error("unsigned hook sent a signature")
+	}
+}
+
+func TestWebhookPostStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, _ *http.Request) {
+		wr.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	h := webhook{url: srv.URL}
+	status, err := h.post(context.Background(), 1, webhookSent, []byte("{}"))
+	if err == nil || status != http.StatusBadGateway {
+		t.Fatalf("post: status %d, err %v", status, err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempts, want := range map[uint]time.Duration{
+		0:  webhookBackoff,
+		1:  webhookBackoff,
+		2:  2 * webhookBackoff,
+		3:  4 * webhookBackoff,
+		4:  8 * webhookBackoff,
+		9:  256 * webhookBackoff,
+		10: webhookMaxBackoff,
+		64: webhookMaxBackoff,
+	} {
+		if got := backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+type deliveryRow struct {
+	attempts  uint
+	status    *int
+	error     *string
+	delivered *int64
+	next      *int64
+}
+
+func getDelivery(t *testing.T, db *database, id int64) (d deliveryRow) {
+	t.Helper()
+	err := db.QueryRow("SELECT `attempts`, `status`, `error`, `delivered`, `next_attempt` FROM `webhook_delivery` WHERE ROWID=?", id).
+		Scan(&d.attempts, &d.status, &d.error, &d.delivered, &d.next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// makeDue moves the next attempt of the delivery to now, as if its backoff had elapsed.
+func makeDue(t *testing.T, db *database, id int64) {
+	t.Helper()
+	if _, err := db.Exec("UPDATE `webhook_delivery` SET `next_attempt`=? WHERE ROWID=?", time.Now().UnixMilli(), id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeliverWebhooksRetry(t *testing.T) {
+	fail, calls := int32(1), int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(wr http.ResponseWriter, _ *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&fail) > 0 {
+			wr.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	const maxAttempts = 3
+	useWebhooks(t, webhook{url: srv.URL, events: map[string]bool{webhookReceived: true}, maxAttempts: maxAttempts})
+	db := testDatabase(t)
+	ctx := context.Background()
+
+	if err := db.queueWebhooks(&webhookEvent{Event: webhookReceived, Content: "hi"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	const id = 1
+
+	for attempt := uint(1); attempt < maxAttempts; attempt++ {
+		before := time.Now()
+		if err := db.deliverWebhooks(ctx); err != nil {
+			t.Fatal(err)
+		}
+		d := getDelivery(t, db, id)
+		if d.attempts != attempt || d.status == nil || *d.status != http.StatusInternalServerError || d.error == nil || d.delivered != nil {
+			t.Fatalf("attempt %d: unexpected delivery %+v", attempt, d)
+		}
+		if d.next == nil {
+			t.Fatalf("attempt %d: no retry scheduled", attempt)
+		}
+		next := time.UnixMilli(*d.next)
+		if lo, hi := before.Add(backoff(attempt)), time.Now().Add(backoff(attempt)); next.Before(lo.Truncate(time.Millisecond)) || next.After(hi) {
+			t.Fatalf("attempt %d: retry at %s, want %s after the attempt", attempt, next, backoff(attempt))
+		}
+
+		// not due yet: nothing is posted
+		if err := db.deliverWebhooks(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if uint(atomic.LoadInt32(&calls)) != attempt {
+			t.Fatalf("attempt %d: posted %d times before the backoff elapsed", attempt, atomic.LoadInt32(&calls))
+		}
+		makeDue(t, db, id)
+	}
+
+	// the last attempt fails for good
+	if err := db.deliverWebhooks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if d := getDelivery(t, db, id); d.attempts != maxAttempts || d.next != nil || d.delivered != nil {
+		t.Fatalf("gave up: unexpected delivery %+v", d)
+	}
+
+	// a queued event is delivered once the hook recovers
+	atomic.StoreInt32(&fail, 0)
+	if err := db.queueWebhooks(&webhookEvent{Event: webhookReceived, Content: "again"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.deliverWebhooks(ctx); err != nil {
+		t.Fatal(err)
+	}
+	d := getDelivery(t, db, id+1)
+	if d.attempts != 1 || d.status == nil || *d.status != http.StatusOK || d.error != nil || d.delivered == nil || d.next != nil {
+		t.Fatalf("delivered: unexpected delivery %+v", d)
+	}
+}
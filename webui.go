@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"html/template"
@@ -18,6 +19,9 @@ type webui struct {
 
 	user *nymo.User
 	db   *database
+	// key and cert open the user of each own send, see sendAuthored
+	key  []byte
+	cert tls.Certificate
 
 	wsLock    sync.RWMutex
 	wsHandler map[*websocket.Conn]chan<- baseClient
@@ -30,6 +34,9 @@ var (
 	web      = webui{wsHandler: make(map[*websocket.Conn]chan<- baseClient)}
 	indexTpl = template.Must(template.New("index.gohtml").Funcs(template.FuncMap{
 		"convertAddr": nymo.ConvertAddrToStr,
+		"previewable": previewable,
+		"fileSize":    fileSize,
+		"markdown":    renderMarkdown,
 	}).ParseFiles("./view/index.gohtml"))
 )
 
@@ -39,6 +46,14 @@ func init() {
 
 func (w *webui) registerRoutes() {
 	w.m.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
+	w.m.HandleFunc("/upload", w.serveUpload)
+	w.m.HandleFunc("/attachment", w.serveAttachment)
+	w.m.HandleFunc("/qr", w.serveQR)
+	w.m.HandleFunc("/avatar", w.serveAvatar)
+	w.m.HandleFunc("/webhooks", w.serveWebhookLog)
+	w.m.HandleFunc("/add", w.serveAdd)
+	w.m.HandleFunc("/stats", w.serveStats)
+	w.m.HandleFunc("/network", w.serveNetwork)
 	w.m.HandleFunc("/", w.serveIndex)
 }
 
@@ -92,18 +107,108 @@ func (w *webui) websocketHandle(conn *websocket.Conn, msgChan chan baseClient) {
 			err = w.newMessage(msg[1])
 		case "alias":
 			err = w.setAlias(msg[1])
+		case "note":
+			err = w.setNote(msg[1])
+		case "tags":
+			err = w.setTags(msg[1])
+		case "state":
+			err = w.setState(msg[1])
 		case "history":
 			var his *history
 			his, err = w.getHistory(msg[1])
 			if err == nil {
 				msgChan <- baseClient{"history", his}
 			}
+		case "read":
+			err = w.readMessages(msg[1])
+		case "receipts":
+			err = w.setReceipts(msg[1])
+		case "group_create":
+			err = w.createGroup(msg[1])
+		case "group_update":
+			err = w.updateGroup(msg[1])
+		case "expiry":
+			err = w.setExpiry(msg[1])
+		case "edit_msg":
+			err = w.editMessage(msg[1])
+		case "retract_msg":
+			err = w.retractMessage(msg[1])
+		case "edits":
+			var e *msgEdits
+			e, err = w.getEdits(msg[1])
+			if err == nil {
+				msgChan <- baseClient{"edits", e}
+			}
+		case "trace":
+			var t *msgTrace
+			t, err = w.traceMessage(msg[1])
+			if err == nil {
+				msgChan <- baseClient{"trace", t}
+			}
+		case "share_contact":
+			err = w.shareContact(msg[1])
+		case "add_contact":
+			var id uint
+			id, err = w.addContact(msg[1])
+			if err == nil {
+				msgChan <- baseClient{"contact_added", id}
+			}
+		case "react":
+			err = w.react(msg[1])
+		case "delete_msg":
+			err = w.deleteMessage(msg[1])
+		case "clear":
+			err = w.clearConversation(msg[1])
+		case "delete_contact":
+			err = w.deleteContact(msg[1])
+		case "fingerprint":
+			var f *fingerprint
+			f, err = w.getFingerprint(msg[1])
+			if err == nil {
+				msgChan <- baseClient{"fingerprint", f}
+			}
+		case "verify":
+			err = w.setVerified(msg[1])
+		case "previews":
+			err = w.setPreviews(msg[1])
+		case "sync":
+			err = w.setSync(msg[1])
+		case "rules":
+			var rules []replyRule
+			rules, err = w.db.replyRules()
+			if err == nil {
+				msgChan <- baseClient{"rules", rules}
+			}
+		case "draft":
+			err = w.setDraft(msg[1])
+		case "scheduled":
+			var list []scheduledMessage
+			list, err = w.listScheduled()
+			if err == nil {
+				msgChan <- baseClient{"scheduled", list}
+			}
+		case "schedule_edit":
+			err = w.editScheduled(msg[1])
+		case "rule_set":
+			err = w.setRule(msg[1])
+		case "rule_delete":
+			err = w.deleteRule(msg[1])
+		case "pin", "mute", "archive":
+			err = w.setFlag(action, msg[1])
 		case "meta":
 			m := metadata{
 				Version: nymo.Version(),
 				Address: w.user.Address().String(),
 				Servers: w.user.ListServers(),
 			}
+			m.Previews, err = w.db.getPreviews()
+			if err != nil {
+				break
+			}
+			m.Sync, err = w.db.getSync()
+			if err != nil {
+				break
+			}
 			w.peer.Range(func(_, value interface{}) bool {
 				m.Peers = append(m.Peers, value.(string))
 				return true
@@ -121,23 +226,43 @@ func (w *webui) websocketHandle(conn *websocket.Conn, msgChan chan baseClient) {
 }
 
 type contact struct {
-	RowID   uint
-	Address []byte
-	Alias   *string
-	Message *string
-	Self    *bool
+	RowID    uint
+	Address  []byte
+	Alias    *string
+	Message  *string
+	Self     bool
+	State    int
+	Receipts bool
+	Group    bool
+	Members  string
+	LastId   *int64
+	Expire   uint
+	Verified bool
+	Note     *string
+	Tags     string
+	Avatar   bool
+	Created  int64
+	LastSeen *int64
+	Pinned   bool
+	Muted    bool
+	Archived bool
 }
 
 type indexRender struct {
 	Contacts []contact
+	Requests []contact
+	Blocked  []contact
+	Archived []contact
 }
 
 func renderIndex(ctx context.Context, db *database, cr *indexRender) error {
-	q, err := db.QueryContext(ctx, "WITH `lmsg` AS (SELECT MAX(ROWID) AS `msg_id` FROM `dec_msg` GROUP BY `target`),"+
-		"`lmsg_c` AS (SELECT * FROM `dec_msg` JOIN `lmsg` ON `dec_msg`.ROWID = `lmsg`.`msg_id`)"+
-		"SELECT `rowid`, `key`, `alias`, `self`, `content` "+
-		"FROM `user` LEFT JOIN `lmsg_c` ON `rowid`=`target` "+
-		"WHERE `rowid`>0 ORDER BY `msg_id` DESC")
+	q, err := db.QueryContext(ctx, "WITH `lmsg` AS (SELECT MAX(ROWID) AS `last_id` FROM `dec_msg` WHERE NOT `quarantine` AND `group` IS NULL GROUP BY `target`),"+
+		"`lmsg_c` AS (SELECT `target`, `self`, "+previewContent+", `last_id` FROM `dec_msg` JOIN `lmsg` ON `dec_msg`.ROWID = `lmsg`.`last_id`)"+
+		"SELECT `u`.`rowid`, `key`, `alias`, `state`, `receipts`, `expire`, `verified`, `note`, "+
+		"IFNULL((SELECT GROUP_CONCAT(`tag`) FROM `user_tag` WHERE `user`=`u`.`rowid`), ''), `avatar` IS NOT NULL, `created`, `last_seen`, "+
+		"`pinned`, `muted`, `archived`, `last_id`, `self`, `content` "+
+		"FROM `user` `u` LEFT JOIN `lmsg_c` ON `u`.`rowid`=`target` "+
+		"WHERE `u`.`rowid`>0")
 
 	if err != nil {
 		return err
@@ -145,13 +270,27 @@ func renderIndex(ctx context.Context, db *database, cr *indexRender) error {
 
 	for q.Next() {
 		var c contact
-		if err := q.Scan(&c.RowID, &c.Address, &c.Alias, &c.Self, &c.Message); err != nil {
+		var self *bool
+		if err := q.Scan(&c.RowID, &c.Address, &c.Alias, &c.State, &c.Receipts, &c.Expire, &c.Verified,
+			&c.Note, &c.Tags, &c.Avatar, &c.Created, &c.LastSeen, &c.Pinned, &c.Muted, &c.Archived, &c.LastId, &self, &c.Message); err != nil {
 			return err
 		}
-		cr.Contacts = append(cr.Contacts, c)
+		c.Self = self != nil && *self
+		switch c.State {
+		case contactRequest:
+			cr.Requests = append(cr.Requests, c)
+		case contactBlocked:
+			cr.Blocked = append(cr.Blocked, c)
+		default:
+			if c.Archived {
+				cr.Archived = append(cr.Archived, c)
+				break
+			}
+			cr.Contacts = append(cr.Contacts, c)
+		}
 	}
 
-	return nil
+	return renderGroups(ctx, db, cr)
 }
 
 func (w *webui) serveIndex(wr http.ResponseWriter, r *http.Request) {